@@ -0,0 +1,93 @@
+package find
+
+import (
+	"bytes"
+	"sort"
+)
+
+// 批量查找的结果，没有找到时Key和Addr都为nil
+type IndexEntry struct {
+	Key  []byte
+	Addr []byte
+}
+
+// 从start开始向后查找不大于target的最后一个索引，先倍增步长再折半
+// 小于start处的Key时返回start-1
+func SeekIndex(r ReaderIndex, target []byte, start int) int {
+	count := r.Count()
+	if start >= count {
+		return count - 1
+	}
+	key := make([]byte, len(target))
+	greater := func(i int) bool {
+		r.ReadIndex(key, i)
+		return bytes.Compare(target, key) < 0
+	}
+	if greater(start) {
+		return start - 1
+	}
+	lo, step := start, 1 // lo处的Key不大于target
+	hi := lo + step
+	for hi < count && !greater(hi) {
+		lo, step = hi, step*2
+		hi = lo + step
+	}
+	if hi > count {
+		hi = count
+	}
+	return lo + sort.Search(hi-lo-1, func(i int) bool {
+		return greater(lo + 1 + i)
+	})
+}
+
+// 批量查找，结果与SearchIndex相同，顺序与targets一致
+// 先将targets排序，再从前往后遍历一次索引，适合大量号码的查找
+func (f *Finder) SearchBatch(targets [][]byte) []IndexEntry {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	result := make([]IndexEntry, len(targets))
+	if f.closed || f.catalog.Count() == 0 {
+		return result
+	}
+	order := make([]int, len(targets))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return bytes.Compare(targets[order[a]], targets[order[b]]) < 0
+	})
+	var (
+		catalog   = f.catalog
+		blockIdx  = -1
+		top, curr = 0, 0 // 顶层索引和当前目录中的位置
+	)
+	for _, n := range order {
+		target := targets[n]
+		if f.Header.BlockSize > 0 { // 先找到所在的块
+			i := SeekIndex(f.catalog, target, top)
+			if i < 0 {
+				continue
+			}
+			if top = i; i != blockIdx {
+				block, err := f.readBlock(i)
+				if err != nil {
+					continue
+				}
+				catalog, blockIdx, curr = block, i, 0
+			}
+		}
+		i := SeekIndex(catalog, target, curr)
+		if i < 0 {
+			continue
+		}
+		curr = i
+		key, addr := f.readEntry(catalog, i)
+		// 与BinSearch一致，大于最后一个Key时视为超出上限
+		if i == catalog.Count()-1 && (f.Header.BlockSize == 0 || blockIdx == f.catalog.Count()-1) &&
+			!bytes.Equal(target, key) {
+			continue
+		}
+		result[n].Key, result[n].Addr = key, addr
+	}
+	return result
+}
@@ -2,7 +2,11 @@ package find
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 	"time"
 
 	"github.com/azhai/gozzo-pck/serialize"
@@ -10,22 +14,40 @@ import (
 
 // 格式说明
 //  ---------------------------
-// |  Header 头部
+// |  Header 头部，以魔数和格式版本开始
 //  ---------------------------
 // |  Record 记录区
 //  ---------------------------
-// |  Subset 子索引，可选
+// |  Subset 子索引，可选，分为多个块，每块BlockSize个索引
 //  ---------------------------
-// |  Index  顶层索引
+// |  Index  顶层索引，有子索引时只有每块的第一个Key
 //  ---------------------------
 
 const (
-	ITEM_SIZE_MAX = 256 // ItemSize的最大值
-	FIX_BYTES     = 4   // IdxBegin、IdxEnd、KeyCount的字节数
-	VER_BYTES     = 4   // 版本号的字节数
+	ITEM_SIZE_MAX = 255     // 定长记录ItemSize的最大值
+	FIX_BYTES     = 4       // IdxBegin、IdxEnd、KeyCount的字节数
+	WIDE_BYTES    = 8       // 64位偏移时IdxBegin、IdxEnd、KeyCount的字节数
+	VER_BYTES     = 4       // 版本号的字节数
+	MAX_FILE_SIZE = 1 << 48 // 头部中偏移的上限，超过时视为损坏的文件
+
+	DAT_MAGIC      = "PCKD" // 数据文件的魔数，旧文件没有
+	FORMAT_VERSION = 4      // 当前的格式版本
+	FORMAT_VARLEN  = 2      // 从这个版本开始，变长记录以长度开头，之前以0x00结尾
+	FORMAT_SUBSET  = 3      // 从这个版本开始，头部有子索引的位置和块大小
+	FORMAT_WIDE    = 4      // 从这个版本开始，头部的偏移为64位，位置可以有5~8字节
+	FORMAT_TRAILER = 0x80   // 格式版本的最高位，有这个标记的文件在索引之后总是有文件尾
 )
 
-type Position = uint32
+type Position = uint64
+
+// 容纳n需要的字节数，至少2字节
+func PositWidth(n uint64) int {
+	size := 2
+	for size < 8 && n>>(8*uint(size)) > 0 {
+		size++
+	}
+	return size
+}
 
 type KeyPair struct {
 	Key []byte
@@ -35,29 +57,78 @@ type KeyPair struct {
 type DatHeader struct {
 	KeySize   int
 	PositSize int
-	IdxBegin  uint32
-	IdxEnd    uint32
-	KeyCount  uint32
+	ItemSize  int
+	Legacy    bool // 没有魔数和格式版本的旧文件
+	Trailer   bool // 索引之后总是有文件尾，没有时是被截断的文件
+	Magic     []byte
+	Format    uint8
+	IdxBegin  uint64
+	IdxEnd    uint64
+	KeyCount  uint64
 	SizeProps uint16
 	Version   string
+	SubBegin  uint64
+	BlockSize uint16
 	*serialize.Object
 }
 
 func NewDatHeader(keySize, positSize int) *DatHeader {
-	p := &DatHeader{
-		KeySize:   keySize,
-		PositSize: positSize,
-		Object:    serialize.NewObject(),
-	}
-	p.AddUintField("idxBegin", 4) // 第一个索引开始位置
-	p.AddUintField("idxEnd", 4)   // 最后一个索引结束位置
-	p.AddUintField("keyCount", 4)
-	// 0-7 ItemSize: 0（变长）~ 256
+	p := NewFormatHeader(FORMAT_VERSION)
+	p.KeySize, p.PositSize = keySize, positSize
+	return p
+}
+
+// 指定格式版本的头部，用于读取之前版本的文件
+func NewFormatHeader(format uint8) *DatHeader {
+	p := &DatHeader{Format: format, Object: serialize.NewObject()}
+	p.AddConstField("magic", []byte(DAT_MAGIC), false)
+	p.AddByteField("format", false)
+	p.addFields()
+	if format >= FORMAT_SUBSET {
+		p.AddUintField("subBegin", p.offsetBytes()) // 子索引开始位置
+		p.AddUintField("blockSize", 2)              // 为0时没有子索引
+	}
+	return p
+}
+
+// 旧文件的头部，只用于读取
+func NewLegacyHeader() *DatHeader {
+	p := &DatHeader{Legacy: true, Object: serialize.NewObject()}
+	p.addFields()
+	return p
+}
+
+// 编码时格式版本加上文件尾的标记，返回的函数用于恢复
+func (p *DatHeader) markTrailer() func() {
+	format := p.Format
+	if p.Trailer {
+		p.Format |= FORMAT_TRAILER
+	}
+	return func() { p.Format = format }
+}
+
+// 是否64位偏移的格式
+func (p *DatHeader) IsWide() bool {
+	return !p.Legacy && p.Format >= FORMAT_WIDE
+}
+
+func (p *DatHeader) offsetBytes() int {
+	if p.IsWide() {
+		return WIDE_BYTES
+	}
+	return FIX_BYTES
+}
+
+func (p *DatHeader) addFields() {
+	size := p.offsetBytes()
+	p.AddUintField("idxBegin", size) // 第一个索引开始位置
+	p.AddUintField("idxEnd", size)   // 最后一个索引结束位置
+	p.AddUintField("keyCount", size)
+	// 0-7 ItemSize: 0（变长）~ 255
 	// 8-12 KeySize: 1 ~ 31
-	// 13-15 PositSize: 2 ~ 4
+	// 13-15 PositSize: 2 ~ 4，64位偏移的格式中为PositSize-1，即2 ~ 8
 	p.AddUintField("sizeProps", 2)
 	p.AddHexStrField("version", 4) // 4字节
-	return p
 }
 
 func (h *DatHeader) GetIndexRange() (int, int) {
@@ -65,13 +136,191 @@ func (h *DatHeader) GetIndexRange() (int, int) {
 }
 
 func (h *DatHeader) GetHeaderSize() int {
-	return FIX_BYTES*3 + 2 + VER_BYTES
 	_, size := h.Matcher.GetLeastSize()
 	return size
 }
 
 func (h *DatHeader) GetSizeProps(itemSize int) uint16 {
-	return uint16(h.PositSize<<13 + h.KeySize<<8 + itemSize)
+	positSize := h.PositSize
+	if h.IsWide() {
+		positSize--
+	}
+	return uint16(positSize<<13 + h.KeySize<<8 + itemSize)
+}
+
+// 从SizeProps中读出各个长度
+func (h *DatHeader) LoadSizeProps() error {
+	h.ItemSize = int(h.SizeProps & 0xff)
+	h.KeySize = int(h.SizeProps>>8) & 0x1f
+	h.PositSize = int(h.SizeProps >> 13)
+	maxPosit := 4
+	if h.IsWide() {
+		h.PositSize, maxPosit = h.PositSize+1, 8
+	}
+	if h.KeySize < 1 || h.PositSize < 2 || h.PositSize > maxPosit {
+		return fmt.Errorf("Invalid key size %d or position size %d",
+			h.KeySize, h.PositSize)
+	}
+	return nil
+}
+
+// 子索引的块数，也是顶层索引的个数
+func (h *DatHeader) GetBlockCount() int {
+	if h.BlockSize == 0 {
+		return 0
+	}
+	size := int(h.BlockSize)
+	return (int(h.KeyCount) + size - 1) / size
+}
+
+// 检查格式版本、长度和索引范围
+func (h *DatHeader) Check() error {
+	if !h.Legacy && (h.Format < 1 || h.Format > FORMAT_VERSION) {
+		return fmt.Errorf("Unsupported format version %d", h.Format)
+	}
+	if h.Legacy || h.Format < FORMAT_SUBSET { // 之前的版本没有子索引
+		h.SubBegin, h.BlockSize = h.IdxBegin, 0
+	}
+	if err := h.LoadSizeProps(); err != nil {
+		return err
+	}
+	if h.IdxEnd > MAX_FILE_SIZE || h.KeyCount > h.IdxEnd { // 避免计算长度时溢出
+		return fmt.Errorf("Invalid index end %d or key count %d", h.IdxEnd, h.KeyCount)
+	}
+	idxBegin, idxEnd := h.GetIndexRange()
+	subBegin := int(h.SubBegin)
+	if subBegin < h.GetHeaderSize() || idxBegin < subBegin || idxEnd < idxBegin {
+		return fmt.Errorf("Invalid index range %d ~ %d ~ %d", subBegin, idxBegin, idxEnd)
+	}
+	unitSize := h.KeySize + h.PositSize
+	if h.BlockSize == 0 {
+		if idxBegin != subBegin || idxEnd-idxBegin != int(h.KeyCount)*unitSize {
+			return fmt.Errorf("The index size %d does not match %d keys",
+				idxEnd-idxBegin, h.KeyCount)
+		}
+		return nil
+	}
+	if idxBegin-subBegin != int(h.KeyCount)*unitSize {
+		return fmt.Errorf("The subset size %d does not match %d keys",
+			idxBegin-subBegin, h.KeyCount)
+	}
+	if idxEnd-idxBegin != h.GetBlockCount()*h.KeySize {
+		return fmt.Errorf("The index size %d does not match %d blocks",
+			idxEnd-idxBegin, h.GetBlockCount())
+	}
+	return nil
+}
+
+// 完整的数据文件，只用于组装，索引位置和个数自动计算
+// 有子索引时KeyCount是子索引的个数，需要另外设置
+type DatFile struct {
+	Record []byte
+	Subset []byte
+	Index  []byte
+	*DatHeader
+}
+
+func NewDatFile(keySize, positSize int) *DatFile {
+	return NewFormatFile(FORMAT_VERSION, keySize, positSize)
+}
+
+func NewFormatFile(format uint8, keySize, positSize int) *DatFile {
+	header := NewFormatHeader(format)
+	header.KeySize, header.PositSize = keySize, positSize
+	f := &DatFile{DatHeader: header}
+	f.AddBytesField("record", 0, false)
+	f.AddBytesField("subset", 0, false)
+	f.AddBytesField("index", 0, false)
+	f.SetOffsetOf("subBegin", "subset")
+	f.SetOffsetOf("idxBegin", "index")
+	f.SetEndOf("idxEnd", "index")
+	return f
+}
+
+// 按头部中的ItemSize和格式版本选择记录的格式
+func (h *DatHeader) NewRecord() *DatRecord {
+	switch {
+	case h.ItemSize > 0:
+		return NewFixedRecord(h.ItemSize)
+	case h.Legacy || h.Format < FORMAT_VARLEN:
+		return NewDatRecord()
+	}
+	return NewVarRecord()
+}
+
+// 从整个文件中取出offset处记录的内容，不复制
+func (h *DatHeader) SliceRecord(data []byte, offset int) ([]byte, error) {
+	if offset < 0 || offset >= len(data) {
+		return nil, fmt.Errorf("The record offset %d is out of range", offset)
+	}
+	data = data[offset:]
+	size := h.ItemSize
+	switch {
+	case h.ItemSize > 0:
+	case h.Legacy || h.Format < FORMAT_VARLEN:
+		if size = MeasureRecord(data); size > 0 {
+			size-- // 去掉结尾的0x00
+		}
+	default:
+		n, k := binary.Uvarint(data)
+		if k <= 0 {
+			return nil, fmt.Errorf("Invalid record size at offset %d", offset)
+		}
+		data, size = data[k:], int(n)
+	}
+	if size < 0 || size > len(data) {
+		return nil, fmt.Errorf("The record at offset %d is truncated", offset)
+	}
+	return data[:size:size], nil
+}
+
+// 一条记录，内容可以包含0x00（以0x00结尾的旧记录除外）
+type DatRecord struct {
+	Size uint64
+	Text []byte
+	*serialize.Object
+}
+
+// 以0x00结尾的记录，用于读取旧文件
+func NewDatRecord() *DatRecord {
+	r := &DatRecord{Object: serialize.NewObject()}
+	r.AddVarChild("text", new(serialize.Bytes), MeasureRecord)
+	return r
+}
+
+// 以长度开头的变长记录
+func NewVarRecord() *DatRecord {
+	r := &DatRecord{Object: serialize.NewObject()}
+	r.AddUvarintField("size", 0)
+	r.AddBytesField("text", 0, false)
+	r.SetLengthOf("size", "text")
+	return r
+}
+
+// 定长记录
+func NewFixedRecord(itemSize int) *DatRecord {
+	r := &DatRecord{Object: serialize.NewObject()}
+	r.AddBytesField("text", itemSize, false)
+	return r
+}
+
+// 记录的内容，去掉旧记录结尾的0x00
+func (r *DatRecord) GetText() []byte {
+	if _, ok := r.GetSizeRef("size"); ok {
+		return r.Text
+	}
+	if f := r.Matcher.GetField("text"); f != nil && f.Measure != nil {
+		return bytes.TrimSuffix(r.Text, []byte{0x00})
+	}
+	return r.Text
+}
+
+// 记录的长度，包含结尾的0x00
+func MeasureRecord(data []byte) int {
+	if n := bytes.IndexByte(data, 0x00); n >= 0 {
+		return n + 1
+	}
+	return -1
 }
 
 type DatIndex struct {
@@ -87,59 +336,143 @@ func NewDatIndex(keySize, positSize int) *DatIndex {
 	return p
 }
 
+// 在内存中组装，Key需要事先排好序且没有重复，大量数据使用StreamBuilder
 type Builder struct {
+	ItemSize  int                // 定长记录的长度，为0时是变长记录
+	BlockSize int                // 子索引每块的索引个数，为0时只有顶层索引
+	Checksum  int                // 校验和的算法，默认CRC32，CHECKSUM_NONE时文件尾中没有校验和
+	SignKey   ed25519.PrivateKey // 签名的私钥，签名时总是使用SHA-256
+	File      *DatFile
 	Header    *DatHeader
 	Record    bytes.Buffer
+	Subset    bytes.Buffer
 	Index     bytes.Buffer
 	IdxObject *DatIndex
 	PosList   []Position
 }
 
 func NewBuilder(keySize, positSize int) *Builder {
+	file := NewDatFile(keySize, positSize)
 	return &Builder{
-		Header:    NewDatHeader(keySize, positSize),
+		Checksum:  CHECKSUM_CRC32,
+		File:      file,
+		Header:    file.DatHeader,
 		IdxObject: NewDatIndex(keySize, positSize),
 	}
 }
 
 func (b *Builder) Build(w io.Writer, rs []string, ks []KeyPair) (err error) {
-	b.Header.SizeProps = b.Header.GetSizeProps(0)
+	if b.ItemSize < 0 || b.ItemSize > ITEM_SIZE_MAX {
+		return fmt.Errorf("The item size %d is out of range 0 ~ %d", b.ItemSize, ITEM_SIZE_MAX)
+	}
+	if b.BlockSize < 0 || b.BlockSize > math.MaxUint16 {
+		return fmt.Errorf("The block size %d is out of range 0 ~ %d", b.BlockSize, math.MaxUint16)
+	}
+	b.chooseFormat(rs, len(ks))
+	b.Header.ItemSize = b.ItemSize
+	b.Header.SizeProps = b.Header.GetSizeProps(b.ItemSize)
+	b.Header.BlockSize = uint16(b.BlockSize)
 	base := b.Header.GetHeaderSize()
-	if b.Header.IdxBegin, err = b.BuildRecord(rs, base); err != nil {
+	if _, err = b.BuildRecord(rs, base); err != nil {
 		return err
 	}
 	if b.Header.KeyCount, err = b.BuildIndex(ks); err != nil {
 		return err
 	}
-	b.Header.IdxEnd = b.Header.IdxBegin + uint32(b.Index.Len())
 	b.Header.Version = time.Now().Format("060102") + "00"
-	headBytes := serialize.Serialize(b.Header)
-	if _, err = w.Write(headBytes); err != nil {
+	b.File.Record, b.File.Subset, b.File.Index = b.Record.Bytes(), b.Subset.Bytes(), b.Index.Bytes()
+	algo := trailerAlgo(b.Checksum, b.SignKey)
+	h, err := NewChecksum(algo)
+	if err != nil {
 		return err
 	}
-	if _, err := b.Record.WriteTo(w); err != nil {
+	b.Header.Trailer = true
+	restore := b.Header.markTrailer()
+	chunk, err := serialize.Serialize(b.File)
+	restore()
+	if err != nil {
 		return err
 	}
-	_, err = b.Index.WriteTo(w)
-	return
+	if _, err = w.Write(chunk); err != nil {
+		return err
+	}
+	h.Write(chunk)
+	return WriteTrailer(w, algo, h, b.SignKey)
+}
+
+// 签名时使用SHA-256
+func trailerAlgo(algo int, key ed25519.PrivateKey) int {
+	if key != nil {
+		return CHECKSUM_SHA256
+	}
+	return algo
 }
 
-func (b *Builder) BuildRecord(records []string, base int) (idxBegin uint32, err error) {
+// 编码后记录的长度
+func (b *Builder) recordSize(text string) int {
+	if b.ItemSize > 0 {
+		return b.ItemSize
+	}
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(len(text))) + len(text)
+}
+
+// 按数据大小选择格式版本和位置的字节数，使用能容纳数据的最小格式
+// 位置超过4字节或者文件超过4GB时，使用64位偏移的格式
+func ChooseFormat(keySize, positSize, blockSize, recSize, keyCount int) (uint8, int) {
+	topSize := 0
+	if blockSize > 0 {
+		topSize = (keyCount + blockSize - 1) / blockSize * keySize
+	}
+	format := uint8(FORMAT_SUBSET)
+	for {
+		recEnd := NewFormatHeader(format).GetHeaderSize() + recSize
+		if size := PositWidth(uint64(recEnd)); size > positSize {
+			positSize = size
+		}
+		total := recEnd + keyCount*(keySize+positSize) + topSize
+		if format == FORMAT_WIDE || (positSize <= 4 && uint64(total) <= math.MaxUint32) {
+			return format, positSize
+		}
+		format = FORMAT_WIDE
+	}
+}
+
+func (b *Builder) chooseFormat(records []string, keyCount int) {
+	keySize, recSize := b.Header.KeySize, 0
+	for _, text := range records {
+		recSize += b.recordSize(text)
+	}
+	format, positSize := ChooseFormat(keySize, b.Header.PositSize, b.BlockSize, recSize, keyCount)
+	if format != b.Header.Format || positSize != b.Header.PositSize {
+		b.File = NewFormatFile(format, keySize, positSize)
+		b.Header = b.File.DatHeader
+		b.IdxObject = NewDatIndex(keySize, positSize)
+	}
+}
+
+func (b *Builder) BuildRecord(records []string, base int) (idxBegin uint64, err error) {
 	var pos Position
-	for _, rec := range records {
+	rec := b.Header.NewRecord()
+	for i, text := range records {
+		if b.ItemSize > 0 && len(text) != b.ItemSize {
+			return 0, fmt.Errorf("The size of record %d is %d, expect %d", i, len(text), b.ItemSize)
+		}
 		pos = Position(base + b.Record.Len())
-		_, err = b.Record.WriteString(rec)
-		b.Record.WriteByte(0x00)
+		rec.Text = []byte(text)
+		if _, err = serialize.SerializeTo(&b.Record, rec); err != nil {
+			return 0, err
+		}
 		b.PosList = append(b.PosList, pos)
 	}
-	idxBegin = uint32(base + b.Record.Len()) // IdxBegin
+	idxBegin = uint64(base + b.Record.Len()) // IdxBegin
 	return
 }
 
-func (b *Builder) BuildIndex(keypairs []KeyPair) (keyCount uint32, err error) {
+func (b *Builder) BuildIndex(keypairs []KeyPair) (keyCount uint64, err error) {
 	var addr Position
 	positCount := len(b.PosList)
-	for _, pair := range keypairs {
+	for i, pair := range keypairs {
 		if pair.Idx < 0 || pair.Idx >= positCount {
 			addr = Position(0)
 		} else {
@@ -147,11 +480,21 @@ func (b *Builder) BuildIndex(keypairs []KeyPair) (keyCount uint32, err error) {
 		}
 		b.IdxObject.Key = pair.Key
 		b.IdxObject.Pos = uint64(addr)
-		chunk := serialize.Serialize(b.IdxObject)
-		_, err = b.Index.Write(chunk)
+		chunk, err := serialize.Serialize(b.IdxObject)
+		if err != nil {
+			return 0, err
+		}
+		if b.BlockSize == 0 {
+			b.Index.Write(chunk)
+			continue
+		}
+		b.Subset.Write(chunk)
+		if i%b.BlockSize == 0 { // 每块的第一个Key
+			b.Index.Write(chunk[:b.Header.KeySize])
+		}
 	}
 	if size := len(keypairs); size > 0 {
-		keyCount = uint32(size)
+		keyCount = uint64(size)
 	}
 	return
 }
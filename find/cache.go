@@ -0,0 +1,64 @@
+package find
+
+import (
+	"container/list"
+	"sync"
+)
+
+const DEFAULT_CACHE_BLOCKS = 64 // 默认缓存的子索引块数
+
+type cacheEntry struct {
+	block   int
+	catalog *Catalog
+}
+
+// 子索引块的LRU缓存，超过容量时淘汰最久没有使用的块
+type BlockCache struct {
+	capacity int
+	items    map[int]*list.Element
+	order    *list.List
+	lock     sync.Mutex
+}
+
+func NewBlockCache(capacity int) *BlockCache {
+	return &BlockCache{
+		capacity: capacity,
+		items:    make(map[int]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *BlockCache) Get(block int) (*Catalog, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.items[block]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).catalog, true
+	}
+	return nil, false
+}
+
+func (c *BlockCache) Put(block int, catalog *Catalog) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.capacity <= 0 {
+		return
+	}
+	if elem, ok := c.items[block]; ok {
+		elem.Value.(*cacheEntry).catalog = catalog
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[block] = c.order.PushFront(&cacheEntry{block: block, catalog: catalog})
+	for c.order.Len() > c.capacity {
+		elem := c.order.Back()
+		c.order.Remove(elem)
+		delete(c.items, elem.Value.(*cacheEntry).block)
+	}
+}
+
+func (c *BlockCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,180 @@
+package find
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/azhai/gozzo-pck/serialize"
+)
+
+// 校验和的算法
+const (
+	CHECKSUM_NONE   = iota
+	CHECKSUM_CRC32  // 只用Sum的前4字节
+	CHECKSUM_SHA256 // 签名时必须使用
+)
+
+const (
+	TRAILER_MAGIC = "PCKS" // 文件尾的魔数，在顶层索引之后
+	SUM_BYTES     = sha256.Size
+)
+
+var (
+	ErrNoChecksum   = errors.New("The dat file has no checksum")
+	ErrNoSignature  = errors.New("The dat file is not signed")
+	ErrChecksum     = errors.New("Checksum mismatch, the dat file is truncated or modified")
+	ErrBadSignature = errors.New("Invalid signature of the dat file")
+)
+
+// 文件尾，校验头部、记录区和索引，签名可选
+type DatTrailer struct {
+	Magic     []byte
+	Algo      uint8
+	Sum       []byte
+	Signature []byte
+	*serialize.Object
+}
+
+func NewDatTrailer() *DatTrailer {
+	t := &DatTrailer{Object: serialize.NewObject()}
+	t.AddConstField("magic", []byte(TRAILER_MAGIC), false)
+	t.AddByteField("algo", false)
+	t.AddBytesField("sum", SUM_BYTES, false)
+	t.AddBytesField("signature", ed25519.SignatureSize, false).Optional = true
+	return t
+}
+
+// CHECKSUM_NONE时返回不计算的Hash，文件尾中的校验和为空
+func NewChecksum(algo int) (hash.Hash, error) {
+	switch algo {
+	case CHECKSUM_NONE:
+		return noChecksum{}, nil
+	case CHECKSUM_CRC32:
+		return crc32.NewIEEE(), nil
+	case CHECKSUM_SHA256:
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("Unknown checksum algorithm %d", algo)
+}
+
+// 不计算校验和
+type noChecksum struct{}
+
+func (noChecksum) Write(p []byte) (int, error) { return len(p), nil }
+func (noChecksum) Sum(b []byte) []byte         { return b }
+func (noChecksum) Reset()                      {}
+func (noChecksum) Size() int                   { return 0 }
+func (noChecksum) BlockSize() int              { return 1 }
+
+// 签名的内容：魔数、算法和校验和
+func (t *DatTrailer) message() []byte {
+	msg := append([]byte(TRAILER_MAGIC), t.Algo)
+	return append(msg, t.Sum...)
+}
+
+func (t *DatTrailer) Sign(key ed25519.PrivateKey) {
+	t.Signature = ed25519.Sign(key, t.message())
+}
+
+// 写出文件尾，有签名时必须是SHA-256
+func WriteTrailer(w io.Writer, algo int, h hash.Hash, key ed25519.PrivateKey) error {
+	if key != nil && algo != CHECKSUM_SHA256 {
+		return errors.New("The signature requires SHA-256 checksum")
+	}
+	t := NewDatTrailer()
+	t.Algo = uint8(algo)
+	t.Sum = make([]byte, SUM_BYTES)
+	copy(t.Sum, h.Sum(nil))
+	if key != nil {
+		t.Sign(key)
+	}
+	_, err := serialize.SerializeTo(w, t)
+	return err
+}
+
+// 读取索引之后的文件尾，之前的文件可能没有，有标记的文件没有文件尾时是被截断了
+// 文件尾中的算法为CHECKSUM_NONE时也返回ErrNoChecksum
+func ReadTrailer(reader io.ReaderAt, header *DatHeader) (*DatTrailer, error) {
+	t := NewDatTrailer()
+	_, err := serialize.UnserializeAt(reader, int64(header.IdxEnd), t)
+	if err == io.EOF && header.Trailer {
+		return nil, ErrChecksum
+	} else if err == io.EOF {
+		return nil, ErrNoChecksum
+	} else if err != nil {
+		return nil, fmt.Errorf("Can not read the checksum: %w", err)
+	}
+	if t.Algo == CHECKSUM_NONE {
+		return nil, ErrNoChecksum
+	}
+	return t, nil
+}
+
+// 检查校验和，pubKey不为空时还要检查签名
+func Verify(reader io.ReaderAt, pubKey ed25519.PublicKey) error {
+	header, err := ReadHeader(reader)
+	if err != nil {
+		return err
+	}
+	return verifyData(reader, header, pubKey)
+}
+
+func verifyData(reader io.ReaderAt, header *DatHeader, pubKey ed25519.PublicKey) error {
+	t, err := ReadTrailer(reader, header)
+	if err != nil {
+		return err
+	}
+	h, err := NewChecksum(int(t.Algo))
+	if err != nil {
+		return err
+	}
+	size := int64(header.IdxEnd)
+	if n, err := io.Copy(h, io.NewSectionReader(reader, 0, size)); err != nil {
+		return err
+	} else if n != size {
+		return ErrChecksum
+	}
+	sum := make([]byte, SUM_BYTES)
+	copy(sum, h.Sum(nil))
+	if !bytes.Equal(sum, t.Sum) {
+		return ErrChecksum
+	}
+	if pubKey == nil {
+		return nil
+	}
+	if len(t.Signature) == 0 {
+		return ErrNoSignature
+	}
+	if t.Algo != CHECKSUM_SHA256 || !ed25519.Verify(pubKey, t.message(), t.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// 打开并检查校验和与签名
+func OpenVerified(reader io.ReaderAt, pubKey ed25519.PublicKey) (*Finder, error) {
+	f, err := Open(reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Verify(pubKey); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// 随时检查文件是否完整
+func (f *Finder) Verify(pubKey ed25519.PublicKey) error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.closed {
+		return ErrClosed
+	}
+	return verifyData(f.reader, f.Header, pubKey)
+}
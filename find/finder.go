@@ -2,8 +2,12 @@ package find
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"os"
 	"sort"
+	"sync"
 
 	"github.com/azhai/gozzo-pck/serialize"
 )
@@ -13,23 +17,32 @@ func GetAddrUint32(addr []byte) uint32 {
 	return obj.Decode(addr).(uint32)
 }
 
+// 按实际宽度读取记录位置，2~8字节
+func GetAddr(addr []byte) uint64 {
+	return serialize.NewUnsigned(len(addr)).DecodeUint64(addr)
+}
+
 type ReaderIndex interface {
 	SetUnitSize(size int)
 	Count() int
 	ReadIndex(data []byte, idx int) (int, error)
 }
 
-// 折半查找
+// 折半查找不大于target的最后一个索引
+// checkTop时大于最后一个Key视为超出上限，等于最后一个Key时返回它
 func BinSearch(r ReaderIndex, target []byte, checkTop bool) int {
 	key := make([]byte, len(target))
 	count := r.Count()
+	if count == 0 {
+		return -1
+	}
 	find := func(i int) bool {
 		r.ReadIndex(key, i)
 		return bytes.Compare(target, key) < 0
 	}
 	if find(0) {
 		return -1 // 超出下限
-	} else if checkTop && !find(-1) {
+	} else if checkTop && !find(-1) && !bytes.Equal(target, key) {
 		return -2 // 超出上限
 	}
 	return sort.Search(count, find) - 1
@@ -52,6 +65,11 @@ func NewCatalog(data []byte) *Catalog {
 	return c
 }
 
+// 直接使用data，不复制，用于内存映射
+func NewCatalogView(data []byte) *Catalog {
+	return &Catalog{data: data, length: len(data)}
+}
+
 func (c *Catalog) SetSource(reader io.ReaderAt, offset, size int) error {
 	c.data = make([]byte, size)
 	n, err := reader.ReadAt(c.data, int64(offset))
@@ -86,52 +104,306 @@ func (c *Catalog) ReadIndex(data []byte, idx int) (int, error) {
 	return c.ReadAt(data, offset)
 }
 
+// 第idx个索引的切片，不复制
+func (c *Catalog) Index(idx int) []byte {
+	if idx < 0 {
+		idx += c.count
+	}
+	start := c.unitSize * idx
+	return c.data[start : start+c.unitSize]
+}
+
+// 有子索引时，内存中只有顶层索引，子索引块按需读取并缓存
+var ErrClosed = errors.New("The finder is closed")
+
+// 可以在多个goroutine中同时查找，Close会等待进行中的查找结束
+// 使用内存映射时，查找结果都是映射的切片，Close之后不能再使用
 type Finder struct {
 	reader  io.ReaderAt
 	catalog *Catalog
+	cache   *BlockCache
+	mapped  []byte    // 内存映射的整个文件
+	closer  io.Closer // OpenFile打开的文件
+	closed  bool
+	lock    sync.RWMutex
 	Header  *DatHeader
 }
 
-func NewFinder(reader io.ReaderAt, keySize, positSize int) (f *Finder, err error) {
-	f = &Finder{
+// 打开数据文件，长度都从头部读取，没有魔数时按旧文件读取
+func Open(reader io.ReaderAt) (*Finder, error) {
+	header, err := ReadHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	f := newFinder(reader, header)
+	idxBegin, idxEnd := header.GetIndexRange()
+	if err := f.catalog.SetSource(f.reader, idxBegin, idxEnd-idxBegin); err != nil {
+		return nil, fmt.Errorf("Can not read the index: %w", err)
+	}
+	f.setUnitSize()
+	return f, nil
+}
+
+// 打开数据文件，查找时从文件中读取
+func OpenFile(path string) (*Finder, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := Open(fp)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	f.closer = fp
+	return f, nil
+}
+
+// 内存映射数据文件，索引和记录都不复制，不支持mmap的系统上使用OpenFile
+func OpenMmap(path string) (*Finder, error) {
+	if !mmapSupported {
+		return OpenFile(path)
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := mmapFile(fp)
+	fp.Close() // 映射不依赖于打开的文件
+	if err != nil {
+		return nil, fmt.Errorf("Can not mmap %s: %w", path, err)
+	}
+	header, err := ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		munmap(data)
+		return nil, err
+	}
+	idxBegin, idxEnd := header.GetIndexRange()
+	if idxEnd > len(data) {
+		munmap(data)
+		return nil, fmt.Errorf("Can not read the index: %w", io.ErrUnexpectedEOF)
+	}
+	f := newFinder(bytes.NewReader(data), header)
+	f.mapped = data
+	f.catalog = NewCatalogView(data[idxBegin:idxEnd])
+	f.setUnitSize()
+	return f, nil
+}
+
+func newFinder(reader io.ReaderAt, header *DatHeader) *Finder {
+	return &Finder{
 		reader:  reader,
 		catalog: NewCatalog(nil),
-		Header:  NewDatHeader(keySize, positSize),
+		cache:   NewBlockCache(DEFAULT_CACHE_BLOCKS),
+		Header:  header,
 	}
-	headData := make([]byte, f.Header.GetHeaderSize())
-	if _, err = f.reader.ReadAt(headData, 0); err != nil {
-		return
+}
+
+func (f *Finder) setUnitSize() {
+	if f.Header.BlockSize > 0 { // 顶层索引只有Key
+		f.catalog.SetUnitSize(f.Header.KeySize)
+	} else {
+		f.catalog.SetUnitSize(f.Header.KeySize + f.Header.PositSize)
 	}
-	if err = serialize.Unserialize(headData, f.Header); err != nil {
-		return
+}
+
+// 释放内存映射或关闭文件
+func (f *Finder) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var err error
+	f.closed = true
+	if f.mapped != nil {
+		err = munmap(f.mapped)
+		f.mapped = nil
 	}
-	idxBegin, idxEnd := f.Header.GetIndexRange()
-	f.catalog.SetSource(f.reader, idxBegin, idxEnd-idxBegin)
-	return
+	if f.closer != nil {
+		if e := f.closer.Close(); err == nil {
+			err = e
+		}
+		f.closer = nil
+	}
+	return err
 }
 
-func (f *Finder) SearchIndex(target []byte) ([]byte, []byte) {
+// 读取并检查头部
+func ReadHeader(reader io.ReaderAt) (*DatHeader, error) {
+	magic := make([]byte, len(DAT_MAGIC)+1) // 魔数和格式版本
+	if _, err := reader.ReadAt(magic, 0); err != nil {
+		return nil, fmt.Errorf("Can not read the header: %w", err)
+	}
+	header := NewLegacyHeader()
+	if string(magic[:len(DAT_MAGIC)]) == DAT_MAGIC {
+		header = NewFormatHeader(magic[len(DAT_MAGIC)] &^ FORMAT_TRAILER)
+	}
+	if _, err := serialize.UnserializeAt(reader, 0, header); err != nil {
+		return nil, fmt.Errorf("Can not read the header: %w", err)
+	}
+	if !header.Legacy { // 去掉文件尾的标记
+		header.Trailer = header.Format&FORMAT_TRAILER != 0
+		header.Format &^= FORMAT_TRAILER
+	}
+	err := header.Check()
+	if err == nil {
+		err = checkFileSize(reader, header)
+	}
+	if err != nil {
+		if header.Legacy {
+			return nil, fmt.Errorf("Unknown or corrupted dat file: %w", err)
+		}
+		return nil, fmt.Errorf("Corrupted dat file: %w", err)
+	}
+	return header, nil
+}
+
+// 读取索引的最后一个字节，确认文件没有被截断，再按头部中的长度分配内存
+func checkFileSize(reader io.ReaderAt, header *DatHeader) error {
+	last := make([]byte, 1)
+	if _, err := reader.ReadAt(last, int64(header.IdxEnd)-1); err != nil {
+		return fmt.Errorf("The index end %d is beyond the file: %w", header.IdxEnd, err)
+	}
+	return nil
+}
+
+// 修改缓存的子索引块数，为0时不缓存
+func (f *Finder) SetCacheSize(blocks int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.cache = NewBlockCache(blocks)
+}
+
+// 读取第i块子索引
+func (f *Finder) readBlock(i int) (*Catalog, error) {
 	unitSize := f.Header.KeySize + f.Header.PositSize
-	f.catalog.SetUnitSize(unitSize)
-	i := BinSearch(f.catalog, target, true)
+	start := i * int(f.Header.BlockSize)
+	count := int(f.Header.KeyCount) - start
+	if count > int(f.Header.BlockSize) {
+		count = int(f.Header.BlockSize)
+	}
+	offset := int(f.Header.SubBegin) + start*unitSize
+	if f.mapped != nil { // 直接使用映射，不需要缓存
+		block := NewCatalogView(f.mapped[offset : offset+count*unitSize])
+		block.SetUnitSize(unitSize)
+		return block, nil
+	}
+	if block, ok := f.cache.Get(i); ok {
+		return block, nil
+	}
+	block := NewCatalog(nil)
+	if err := block.SetSource(f.reader, offset, count*unitSize); err != nil {
+		return nil, err
+	}
+	block.SetUnitSize(unitSize)
+	f.cache.Put(i, block)
+	return block, nil
+}
+
+// 长度与头部不一致时报错，新代码使用Open
+func NewFinder(reader io.ReaderAt, keySize, positSize int) (*Finder, error) {
+	f, err := Open(reader)
+	if err != nil {
+		return nil, err
+	}
+	if f.Header.KeySize != keySize || f.Header.PositSize != positSize {
+		return nil, fmt.Errorf("Expect key size %d and position size %d, but the file has %d and %d",
+			keySize, positSize, f.Header.KeySize, f.Header.PositSize)
+	}
+	return f, nil
+}
+
+// 找到不大于target的最后一个Key，返回Key和记录位置，没有找到时都为nil
+func (f *Finder) SearchIndex(target []byte) ([]byte, []byte) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.closed {
+		return nil, nil
+	}
+	catalog, i := f.catalog, -1
+	if f.Header.BlockSize == 0 {
+		i = BinSearch(catalog, target, true)
+	} else if n := BinSearch(catalog, target, false); n >= 0 { // 先在顶层索引中找到所在的块
+		var err error
+		if catalog, err = f.readBlock(n); err == nil {
+			i = BinSearch(catalog, target, n == f.catalog.Count()-1)
+		}
+	}
 	if i < 0 {
 		return nil, nil
 	}
-	index := make([]byte, unitSize)
-	f.catalog.ReadIndex(index, i)
+	return f.readEntry(catalog, i)
+}
+
+// 第i个索引的Key和记录位置
+func (f *Finder) readEntry(catalog *Catalog, i int) ([]byte, []byte) {
+	var index []byte
+	if f.mapped != nil {
+		index = catalog.Index(i)
+	} else {
+		index = make([]byte, f.Header.KeySize+f.Header.PositSize)
+		catalog.ReadIndex(index, i)
+	}
 	sep := f.Header.KeySize
 	return index[:sep], index[sep:]
 }
 
+// 读取记录，位置为0（指向头部）表示没有记录，返回nil
 func (f *Finder) GetRecord(addr []byte) ([]byte, error) {
-	data := make([]byte, ITEM_SIZE_MAX)
-	offset := int64(GetAddrUint32(addr))
-	_, err := f.reader.ReadAt(data, offset)
-	if err == nil {
-		n := bytes.IndexByte(data, 0x00)
-		if n >= 0 {
-			data = data[:n]
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.closed {
+		return nil, ErrClosed
+	}
+	return f.getRecord(addr)
+}
+
+func (f *Finder) getRecord(addr []byte) ([]byte, error) {
+	offset := int64(GetAddr(addr))
+	if offset == 0 {
+		return nil, nil
+	}
+	if f.mapped != nil {
+		return f.Header.SliceRecord(f.mapped, int(offset))
+	}
+	rec := f.Header.NewRecord()
+	if _, err := serialize.UnserializeAt(f.reader, offset, rec); err != nil {
+		return nil, err
+	}
+	return rec.GetText(), nil
+}
+
+// 按Key的顺序遍历所有索引和记录，fn返回错误时停止并返回这个错误
+// 遍历时持有读锁，fn中不能调用这个Finder的方法
+func (f *Finder) Walk(fn func(key, addr, record []byte) error) error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.closed {
+		return ErrClosed
+	}
+	if f.Header.BlockSize == 0 {
+		return f.walkCatalog(f.catalog, fn)
+	}
+	for n := 0; n < f.Header.GetBlockCount(); n++ {
+		block, err := f.readBlock(n)
+		if err != nil {
+			return err
+		}
+		if err = f.walkCatalog(block, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Finder) walkCatalog(catalog *Catalog, fn func(key, addr, record []byte) error) error {
+	for i := 0; i < catalog.Count(); i++ {
+		key, addr := f.readEntry(catalog, i)
+		record, err := f.getRecord(addr)
+		if err != nil {
+			return err
+		}
+		if err = fn(key, addr, record); err != nil {
+			return err
 		}
 	}
-	return data, err
+	return nil
 }
@@ -0,0 +1,767 @@
+package find
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-pck/serialize"
+	"github.com/stretchr/testify/assert"
+)
+
+// 1000个记录，Key为0、10、20……
+func buildData(t *testing.T, blockSize int) []byte {
+	var (
+		records  []string
+		keypairs []KeyPair
+	)
+	for i := 0; i < 1000; i++ {
+		records = append(records, fmt.Sprintf("record\x00%d", i))
+		keypairs = append(keypairs, KeyPair{Key: uint32Key(i * 10), Idx: i})
+	}
+	var buf bytes.Buffer
+	b := NewBuilder(4, 4)
+	b.BlockSize = blockSize
+	assert.NoError(t, b.Build(&buf, records, keypairs))
+	return buf.Bytes()
+}
+
+func uint32Key(n int) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(n))
+	return key
+}
+
+func openFinders(t *testing.T, blockSize int) []*Finder {
+	return openData(t, buildData(t, blockSize))
+}
+
+// 分别用Open和OpenMmap打开
+func openData(t *testing.T, data []byte) []*Finder {
+	f, err := Open(bytes.NewReader(data))
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "test.dat")
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+	m, err := OpenMmap(path)
+	assert.NoError(t, err)
+	return []*Finder{f, m}
+}
+
+func TestFinder(t *testing.T) {
+	for _, blockSize := range []int{0, 16} {
+		for _, f := range openFinders(t, blockSize) {
+			key, addr := f.SearchIndex(uint32Key(1234))
+			assert.Equal(t, uint32Key(1230), key)
+			rec, err := f.GetRecord(addr)
+			assert.NoError(t, err)
+			assert.Equal(t, "record\x00123", string(rec))
+			// 最后一个Key可以找到，大于它时超出上限
+			key, addr = f.SearchIndex(uint32Key(9990))
+			assert.Equal(t, uint32Key(9990), key)
+			rec, _ = f.GetRecord(addr)
+			assert.Equal(t, "record\x00999", string(rec))
+			_, addr = f.SearchIndex(uint32Key(9991))
+			assert.Nil(t, addr)
+			_, addr = f.SearchIndex(uint32Key(99999))
+			assert.Nil(t, addr)
+			assert.NoError(t, f.Close())
+			_, err = f.GetRecord(addr)
+			assert.Equal(t, ErrClosed, err)
+		}
+	}
+	_, err := Open(bytes.NewReader([]byte("not a dat file at all")))
+	assert.Error(t, err)
+}
+
+// 旧文件：没有魔数，以0x00结尾的记录，Key为1和5
+func buildLegacy(t *testing.T) []byte {
+	h := NewLegacyHeader()
+	h.KeySize, h.PositSize = 4, 4
+	h.SizeProps = h.GetSizeProps(0)
+	base := uint64(h.GetHeaderSize())
+	records := []byte("one\x00two\x00")
+	h.IdxBegin = base + uint64(len(records))
+	h.IdxEnd, h.KeyCount, h.Version = h.IdxBegin+16, 2, "19010100"
+	chunk, err := serialize.Serialize(h)
+	assert.NoError(t, err)
+	chunk = append(chunk, records...)
+	for i, key := range []int{1, 5} {
+		chunk = append(chunk, uint32Key(key)...)
+		chunk = append(chunk, uint32Key(int(base)+i*4)...)
+	}
+	return chunk
+}
+
+func TestOpenHeader(t *testing.T) {
+	data := buildData(t, 0)
+	f, err := Open(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.False(t, f.Header.Legacy)
+	assert.Equal(t, []byte(DAT_MAGIC), f.Header.Magic)
+	assert.Equal(t, 4, f.Header.KeySize)
+	assert.Equal(t, 0, f.Header.ItemSize)
+	assert.Equal(t, uint64(1000), f.Header.KeyCount)
+	// 旧文件
+	legacy := buildLegacy(t)
+	f, err = Open(bytes.NewReader(legacy))
+	assert.NoError(t, err)
+	assert.True(t, f.Header.Legacy)
+	assert.Equal(t, 4, f.Header.PositSize)
+	key, addr := f.SearchIndex(uint32Key(3))
+	assert.Equal(t, uint32Key(1), key)
+	rec, err := f.GetRecord(addr)
+	assert.NoError(t, err)
+	assert.Equal(t, "one", string(rec))
+	// 不支持的格式版本
+	bad := append([]byte{}, data...)
+	bad[len(DAT_MAGIC)] = FORMAT_VERSION + 1
+	_, err = Open(bytes.NewReader(bad))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unsupported format version")
+	// 截断的文件
+	_, err = Open(bytes.NewReader(data[:len(data)/2]))
+	assert.Error(t, err)
+	_, err = Open(bytes.NewReader(legacy[:len(legacy)-1]))
+	assert.Error(t, err)
+	// 不是数据文件
+	_, err = Open(bytes.NewReader([]byte("not a dat file at all")))
+	assert.Error(t, err)
+}
+
+// 头部自洽但个数很大的损坏文件，不能按头部分配内存
+func TestCorruptedHeader(t *testing.T) {
+	for _, format := range []uint8{FORMAT_SUBSET, FORMAT_WIDE} {
+		h := NewFormatHeader(format)
+		h.KeySize, h.PositSize = 4, 4
+		h.SizeProps = h.GetSizeProps(0)
+		h.SubBegin = uint64(h.GetHeaderSize())
+		h.IdxBegin, h.KeyCount, h.Version = h.SubBegin, 1<<28, "26101900"
+		if format == FORMAT_WIDE {
+			h.KeyCount = 1 << 40
+		}
+		h.IdxEnd = h.IdxBegin + h.KeyCount*8
+		chunk, err := serialize.Serialize(h)
+		assert.NoError(t, err)
+		data := make([]byte, 100)
+		copy(data, chunk)
+		_, err = Open(bytes.NewReader(data))
+		assert.Error(t, err)
+		t.Log(err)
+		path := filepath.Join(t.TempDir(), "bad.dat")
+		assert.NoError(t, os.WriteFile(path, data, 0644))
+		_, err = OpenMmap(path)
+		assert.Error(t, err)
+		_, err = OpenFile(path)
+		assert.Error(t, err)
+	}
+}
+
+// 变长记录：包含0x00、超过256字节、靠近文件结尾
+func TestVarRecord(t *testing.T) {
+	records := []string{"a\x00b", strings.Repeat("long", 100), "", "\x00\x00", "last"}
+	var keypairs []KeyPair
+	for i := range records {
+		keypairs = append(keypairs, KeyPair{Key: uint32Key(i * 10), Idx: i})
+	}
+	keypairs = append(keypairs, KeyPair{Key: uint32Key(100), Idx: -1}) // 没有记录的Key
+	var buf bytes.Buffer
+	b := NewBuilder(4, 4)
+	b.Checksum = CHECKSUM_NONE // 最后一条记录离文件结尾不到256字节
+	assert.NoError(t, b.Build(&buf, records, keypairs))
+	for _, f := range openData(t, buf.Bytes()) {
+		assert.Equal(t, 0, f.Header.ItemSize)
+		for i, text := range records {
+			_, addr := f.SearchIndex(uint32Key(i*10 + 5))
+			rec, err := f.GetRecord(addr)
+			assert.NoError(t, err)
+			assert.Equal(t, text, string(rec))
+		}
+		_, addr := f.SearchIndex(uint32Key(100))
+		rec, err := f.GetRecord(addr)
+		assert.NoError(t, err)
+		assert.Nil(t, rec)
+		f.Close()
+	}
+	// 正好在数据结尾的记录
+	header := NewDatHeader(4, 4)
+	rec := header.NewRecord()
+	rec.Text = []byte(strings.Repeat("\x00x", 200))
+	chunk, err := serialize.Serialize(rec)
+	assert.NoError(t, err)
+	read := header.NewRecord()
+	n, err := serialize.UnserializeAt(bytes.NewReader(chunk), 0, read)
+	assert.NoError(t, err)
+	assert.Equal(t, len(chunk), n)
+	assert.Equal(t, rec.Text, read.GetText())
+	text, err := header.SliceRecord(chunk, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, rec.Text, text)
+	_, err = header.SliceRecord(chunk[:len(chunk)-1], 0)
+	assert.Error(t, err)
+}
+
+// 定长记录：长度必须一致，内容原样返回
+func TestFixedRecord(t *testing.T) {
+	records := []string{"ab\x00d", "\x00\x00\x00\x00", "wxyz"}
+	keypairs := []KeyPair{{uint32Key(1), 0}, {uint32Key(2), 1}, {uint32Key(3), 2}, {uint32Key(9), 0}}
+	var buf bytes.Buffer
+	b := NewBuilder(4, 4)
+	b.ItemSize = 4
+	assert.NoError(t, b.Build(&buf, records, keypairs))
+	for _, f := range openData(t, buf.Bytes()) {
+		assert.Equal(t, 4, f.Header.ItemSize)
+		for i, text := range records {
+			_, addr := f.SearchIndex(uint32Key(i + 1))
+			rec, err := f.GetRecord(addr)
+			assert.NoError(t, err)
+			assert.Equal(t, text, string(rec))
+		}
+		f.Close()
+	}
+	b = NewBuilder(4, 4)
+	b.ItemSize = 4
+	err := b.Build(&buf, []string{"abcd", "abc"}, keypairs[:2])
+	assert.EqualError(t, err, "The size of record 1 is 3, expect 4")
+	b = NewBuilder(4, 4)
+	b.ItemSize = ITEM_SIZE_MAX + 1
+	assert.Error(t, b.Build(&buf, records, keypairs))
+	sb := NewStreamBuilder(&buf, 4, 4)
+	sb.ItemSize = 4
+	_, err = sb.AddRecord([]byte("abcde"))
+	assert.Error(t, err)
+	sb.Close()
+}
+
+func TestBlockCache(t *testing.T) {
+	c := NewBlockCache(2)
+	blocks := []*Catalog{NewCatalog(nil), NewCatalog(nil), NewCatalog(nil)}
+	c.Put(0, blocks[0])
+	c.Put(1, blocks[1])
+	got, ok := c.Get(0) // 0变为最近使用，淘汰1
+	assert.True(t, ok)
+	assert.Equal(t, blocks[0], got)
+	c.Put(2, blocks[2])
+	assert.Equal(t, 2, c.Len())
+	_, ok = c.Get(1)
+	assert.False(t, ok)
+	_, ok = c.Get(0)
+	assert.True(t, ok)
+	_, ok = c.Get(2)
+	assert.True(t, ok)
+	c.Put(2, blocks[1]) // 替换已有的块
+	got, _ = c.Get(2)
+	assert.Equal(t, blocks[1], got)
+	assert.Equal(t, 2, c.Len())
+	c = NewBlockCache(0) // 不缓存
+	c.Put(0, blocks[0])
+	assert.Equal(t, 0, c.Len())
+}
+
+// 记录ReadAt的次数
+type countingReader struct {
+	io.ReaderAt
+	reads int
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	r.reads++
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+// 子索引块边界上的查找，每次查找最多读一次子索引块
+func TestSubsetIndex(t *testing.T) {
+	const blockSize = 16
+	r := &countingReader{ReaderAt: bytes.NewReader(buildData(t, blockSize))}
+	f, err := Open(r)
+	assert.NoError(t, err)
+	assert.Equal(t, (1000+blockSize-1)/blockSize, f.catalog.Count()) // 顶层索引只有每块的第一个Key
+	f.SetCacheSize(2)
+	for n := 1; n < 1000/blockSize; n++ {
+		first := n * blockSize * 10 // 块的第一个Key
+		for _, target := range []int{first - 1, first, first + 1} {
+			want := target / 10 * 10
+			r.reads = 0
+			key, _ := f.SearchIndex(uint32Key(target))
+			assert.Equal(t, uint32Key(want), key, "target %d", target)
+			assert.LessOrEqual(t, r.reads, 1)
+		}
+	}
+	r.reads = 0
+	f.SearchIndex(uint32Key(16*10 + 5)) // 刚使用过的块在缓存中
+	f.SearchIndex(uint32Key(16*10 + 5))
+	assert.Equal(t, 1, r.reads)
+	assert.LessOrEqual(t, f.cache.Len(), 2)
+	r.reads = 0
+	f.SetCacheSize(0)
+	f.SearchIndex(uint32Key(55))
+	f.SearchIndex(uint32Key(55))
+	assert.Equal(t, 2, r.reads)
+	key, _ := f.SearchIndex(uint32Key(0))
+	assert.Equal(t, uint32Key(0), key)
+	key, _ = f.SearchIndex(uint32Key(9985))
+	assert.Equal(t, uint32Key(9980), key)
+}
+
+// 内存映射与从文件读取的结果相同
+func TestMmapParity(t *testing.T) {
+	for _, blockSize := range []int{0, 16} {
+		data := buildData(t, blockSize)
+		path := filepath.Join(t.TempDir(), "test.dat")
+		assert.NoError(t, os.WriteFile(path, data, 0644))
+		f, err := OpenFile(path)
+		assert.NoError(t, err)
+		m, err := OpenMmap(path)
+		assert.NoError(t, err)
+		assert.Equal(t, mmapSupported, m.mapped != nil)
+		assert.Equal(t, f.Header.KeyCount, m.Header.KeyCount)
+		for target := -5; target < 10005; target += 3 {
+			key1, addr1 := f.SearchIndex(uint32Key(target))
+			key2, addr2 := m.SearchIndex(uint32Key(target))
+			assert.Equal(t, key1, key2, "target %d", target)
+			assert.Equal(t, addr1, addr2, "target %d", target)
+			if addr1 == nil {
+				continue
+			}
+			rec1, err1 := f.GetRecord(addr1)
+			rec2, err2 := m.GetRecord(addr2)
+			assert.NoError(t, err1)
+			assert.NoError(t, err2)
+			assert.Equal(t, rec1, rec2)
+			assert.Equal(t, len(rec2), cap(rec2)) // 映射的切片，不能追加到后面的数据
+		}
+		assert.NoError(t, f.Close())
+		assert.NoError(t, m.Close())
+	}
+}
+
+// Close之后不能再查找，重复Close没有影响
+func TestCloseThenUse(t *testing.T) {
+	for _, f := range openFinders(t, 16) {
+		_, addr := f.SearchIndex(uint32Key(100))
+		assert.NoError(t, f.Close())
+		assert.NoError(t, f.Close())
+		key, none := f.SearchIndex(uint32Key(100))
+		assert.Nil(t, key)
+		assert.Nil(t, none)
+		_, err := f.GetRecord(addr)
+		assert.Equal(t, ErrClosed, err)
+		assert.Equal(t, ErrClosed, f.Walk(func(key, addr, record []byte) error {
+			return nil
+		}))
+		assert.Equal(t, []IndexEntry{{}}, f.SearchBatch([][]byte{uint32Key(100)}))
+		assert.Equal(t, ErrClosed, f.Verify(nil))
+	}
+	path := filepath.Join(t.TempDir(), "test.dat")
+	assert.NoError(t, os.WriteFile(path, buildData(t, 0), 0644))
+	_, err := OpenMmap(filepath.Join(t.TempDir(), "missing.dat"))
+	assert.Error(t, err)
+	f, err := OpenFile(path)
+	assert.NoError(t, err)
+	fp := f.closer.(*os.File)
+	assert.NoError(t, f.Close())
+	_, err = fp.Stat() // 文件已经关闭
+	assert.Error(t, err)
+}
+
+func TestWalk(t *testing.T) {
+	for _, blockSize := range []int{0, 16} {
+		for _, f := range openFinders(t, blockSize) {
+			count := 0
+			err := f.Walk(func(key, addr, record []byte) error {
+				assert.Equal(t, uint32Key(count*10), key)
+				assert.Equal(t, fmt.Sprintf("record\x00%d", count), string(record))
+				count++
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, 1000, count)
+			stop := fmt.Errorf("stop")
+			assert.Equal(t, stop, f.Walk(func(key, addr, record []byte) error {
+				return stop
+			}))
+			f.Close()
+		}
+	}
+}
+
+func TestSearchBatch(t *testing.T) {
+	targets := [][]byte{uint32Key(0), uint32Key(9990), uint32Key(9991), uint32Key(20000)}
+	for i := 0; i < 2000; i++ {
+		targets = append(targets, uint32Key(rand.Intn(10100)))
+	}
+	for _, blockSize := range []int{0, 1, 7, 64} {
+		for _, f := range openFinders(t, blockSize) {
+			result := f.SearchBatch(targets)
+			assert.Len(t, result, len(targets))
+			assert.Equal(t, uint32Key(9990), result[1].Key)
+			assert.Nil(t, result[2].Key)
+			for i, target := range targets {
+				key, addr := f.SearchIndex(target)
+				assert.Equal(t, key, result[i].Key, "%x", target)
+				assert.Equal(t, addr, result[i].Addr, "%x", target)
+			}
+			f.Close()
+		}
+	}
+}
+
+// 用 go test -race 检查
+func TestConcurrentFind(t *testing.T) {
+	for _, blockSize := range []int{0, 16} {
+		for _, f := range openFinders(t, blockSize) {
+			f.SetCacheSize(4)
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := g; i < 9990; i += 37 {
+						_, addr := f.SearchIndex(uint32Key(i))
+						rec, err := f.GetRecord(addr)
+						assert.NoError(t, err)
+						assert.Equal(t, fmt.Sprintf("record\x00%d", i/10), string(rec))
+					}
+					result := f.SearchBatch([][]byte{uint32Key(g * 100), uint32Key(5)})
+					assert.Equal(t, uint32Key(g*100), result[0].Key)
+				}(g)
+			}
+			wg.Wait()
+			assert.NoError(t, f.Close())
+		}
+	}
+}
+
+func TestWidePosition(t *testing.T) {
+	assert.Equal(t, 2, PositWidth(0xffff))
+	assert.Equal(t, 3, PositWidth(0x10000))
+	assert.Equal(t, 5, PositWidth(1<<32))
+	assert.Equal(t, 8, PositWidth(1<<63))
+	// 记录超过64KB时自动加宽位置
+	long := string(bytes.Repeat([]byte{'x'}, 70000))
+	keypairs := []KeyPair{{Key: uint32Key(1), Idx: 0}, {Key: uint32Key(2), Idx: 1}, {Key: uint32Key(3), Idx: 1}}
+	for _, positSize := range []int{2, 6} {
+		var buf bytes.Buffer
+		b := NewBuilder(4, positSize)
+		assert.NoError(t, b.Build(&buf, []string{long, "tail"}, keypairs))
+		f, err := Open(bytes.NewReader(buf.Bytes()))
+		assert.NoError(t, err)
+		if positSize > 4 {
+			assert.Equal(t, uint8(FORMAT_WIDE), f.Header.Format)
+			assert.Equal(t, positSize, f.Header.PositSize)
+		} else {
+			assert.Equal(t, uint8(FORMAT_SUBSET), f.Header.Format)
+			assert.Equal(t, 3, f.Header.PositSize)
+		}
+		_, addr := f.SearchIndex(uint32Key(2))
+		assert.Len(t, addr, f.Header.PositSize)
+		rec, err := f.GetRecord(addr)
+		assert.NoError(t, err)
+		assert.Equal(t, "tail", string(rec))
+	}
+}
+
+func TestStreamBuilder(t *testing.T) {
+	dir := t.TempDir()
+	for _, blockSize := range []int{0, 16} {
+		var buf bytes.Buffer
+		b := NewStreamBuilder(&buf, 4, 2)
+		b.BlockSize, b.RunSize, b.TempDir = blockSize, 100, dir
+		var positions []Position
+		for i := 0; i < 1000; i++ {
+			pos, err := b.AddRecord([]byte(fmt.Sprintf("record\x00%d", i%300)))
+			assert.NoError(t, err)
+			positions = append(positions, pos)
+		}
+		assert.Equal(t, positions[5], positions[305]) // 相同的记录只保存一次
+		for _, i := range rand.Perm(1000) {
+			assert.NoError(t, b.AddKey(uint32Key(i*10), positions[i]))
+		}
+		assert.NoError(t, b.Finish())
+		files, _ := os.ReadDir(dir)
+		assert.Len(t, files, 0) // 临时文件已删除
+		f, err := Open(bytes.NewReader(buf.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1000), f.Header.KeyCount)
+		for i := 0; i < 9990; i += 7 {
+			_, addr := f.SearchIndex(uint32Key(i))
+			rec, err := f.GetRecord(addr)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("record\x00%d", i/10%300), string(rec))
+		}
+	}
+	// 重复和冲突的Key
+	for _, skip := range []bool{false, true} {
+		b := NewStreamBuilder(io.Discard, 4, 2)
+		b.RunSize, b.SkipDuplicate = 2, skip
+		a, _ := b.AddRecord([]byte("a"))
+		c, _ := b.AddRecord([]byte("c"))
+		assert.NoError(t, b.AddKey(uint32Key(1), a))
+		assert.NoError(t, b.AddKey(uint32Key(2), c))
+		assert.NoError(t, b.AddKey(uint32Key(1), a))
+		err := b.Finish()
+		if skip {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, "Duplicate key 00000001")
+		}
+	}
+	b := NewStreamBuilder(io.Discard, 4, 2)
+	a, _ := b.AddRecord([]byte("a"))
+	c, _ := b.AddRecord([]byte("c"))
+	b.AddKey(uint32Key(1), a)
+	b.AddKey(uint32Key(1), c)
+	err := b.Finish()
+	assert.IsType(t, &KeyError{}, err)
+	assert.Error(t, b.AddKey([]byte{1, 2}, a))
+}
+
+func TestStreamMerge(t *testing.T) {
+	dir := t.TempDir()
+	for _, skip := range []bool{false, true} {
+		var buf bytes.Buffer
+		b := NewStreamBuilder(&buf, 4, 2)
+		b.RunSize, b.MergeWidth, b.TempDir, b.SkipDuplicate = 10, 3, dir, skip
+		pos, err := b.AddRecord([]byte("rec"))
+		assert.NoError(t, err)
+		for _, i := range rand.Perm(1000) {
+			assert.NoError(t, b.AddKey(uint32Key(i), pos))
+		}
+		assert.NoError(t, b.AddKey(uint32Key(500), pos)) // 分在不同序列中的重复Key
+		files, _ := os.ReadDir(dir)
+		assert.Len(t, files, 101) // 100个序列和记录，序列都已关闭
+		err = b.Finish()
+		files, _ = os.ReadDir(dir)
+		assert.Len(t, files, 0)
+		if !skip {
+			assert.EqualError(t, err, "Duplicate key 000001f4")
+			continue
+		}
+		assert.NoError(t, err)
+		f, err := Open(bytes.NewReader(buf.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1000), f.Header.KeyCount)
+		var last []byte
+		assert.NoError(t, f.Walk(func(key, addr, record []byte) error {
+			if last != nil {
+				assert.Equal(t, 1, bytes.Compare(key, last))
+			}
+			last = append(last[:0], key...)
+			assert.Equal(t, "rec", string(record))
+			return nil
+		}))
+	}
+	// 放弃组装时也删除临时文件
+	b := NewStreamBuilder(io.Discard, 4, 2)
+	b.RunSize, b.TempDir = 2, dir
+	pos, _ := b.AddRecord([]byte("rec"))
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, b.AddKey(uint32Key(i), pos))
+	}
+	assert.NoError(t, b.Close())
+	files, _ := os.ReadDir(dir)
+	assert.Len(t, files, 0)
+}
+
+func TestStreamDedup(t *testing.T) {
+	b := NewStreamBuilder(io.Discard, 4, 2)
+	b.DedupSize = 2
+	add := func(rec string) Position {
+		pos, err := b.AddRecord([]byte(rec))
+		assert.NoError(t, err)
+		return pos
+	}
+	a, c := add("a"), add("b")
+	assert.NotEqual(t, a, c)
+	c = add("c")
+	assert.Len(t, b.digests, 2) // 摘要满了，不再记录
+	assert.Equal(t, a, add("a"))
+	assert.NotEqual(t, c, add("c"))
+	assert.NoError(t, b.Close())
+
+	b = NewStreamBuilder(io.Discard, 4, 2)
+	b.DedupSize = -1 // 不去重
+	a = add("a")
+	assert.NotEqual(t, a, add("a"))
+	assert.Len(t, b.digests, 0)
+	assert.NoError(t, b.Close())
+}
+
+func TestChecksum(t *testing.T) {
+	data := buildData(t, 0)
+	assert.NoError(t, Verify(bytes.NewReader(data), nil))
+	bad := append([]byte{}, data...)
+	bad[100] ^= 0xff
+	assert.Equal(t, ErrChecksum, Verify(bytes.NewReader(bad), nil))
+	_, err := OpenVerified(bytes.NewReader(bad), nil)
+	assert.Equal(t, ErrChecksum, err)
+	assert.Error(t, Verify(bytes.NewReader(data[:len(data)-10]), nil))
+	// 签名
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	var buf bytes.Buffer
+	b := NewStreamBuilder(&buf, 4, 2)
+	b.SignKey = priv
+	pos, _ := b.AddRecord([]byte("signed"))
+	b.AddKey(uint32Key(1), pos)
+	assert.NoError(t, b.Finish())
+	f, err := OpenVerified(bytes.NewReader(buf.Bytes()), pub)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrBadSignature, f.Verify(other))
+	assert.Equal(t, ErrNoSignature, Verify(bytes.NewReader(data), pub))
+	// 不写校验和
+	buf.Reset()
+	c := NewBuilder(4, 2)
+	c.Checksum = CHECKSUM_NONE
+	assert.NoError(t, c.Build(&buf, []string{"a"}, []KeyPair{{Key: uint32Key(1)}}))
+	assert.Equal(t, ErrNoChecksum, Verify(bytes.NewReader(buf.Bytes()), nil))
+	f, err = Open(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.True(t, f.Header.Trailer)
+	assert.Equal(t, ErrNoChecksum, f.Verify(nil)) // 没有校验和也有文件尾
+	end := int(f.Header.IdxEnd)
+	assert.Equal(t, ErrChecksum, Verify(bytes.NewReader(buf.Bytes()[:end]), nil))
+}
+
+// 在索引结束处截断的文件，只有之前的文件可以没有文件尾
+func TestMissingTrailer(t *testing.T) {
+	data := buildData(t, 0)
+	f, err := Open(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.True(t, f.Header.Trailer)
+	assert.Equal(t, uint8(FORMAT_SUBSET), f.Header.Format)
+	assert.Equal(t, uint8(FORMAT_SUBSET|FORMAT_TRAILER), data[len(DAT_MAGIC)])
+	cut := data[:f.Header.IdxEnd]
+	_, err = Open(bytes.NewReader(cut))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrChecksum, Verify(bytes.NewReader(cut), nil))
+	// 没有标记的文件
+	old := append([]byte{}, cut...)
+	old[len(DAT_MAGIC)] = FORMAT_SUBSET
+	f, err = Open(bytes.NewReader(old))
+	assert.NoError(t, err)
+	assert.False(t, f.Header.Trailer)
+	assert.Equal(t, ErrNoChecksum, Verify(bytes.NewReader(old), nil))
+	assert.Equal(t, ErrNoChecksum, Verify(bytes.NewReader(buildLegacy(t)), nil))
+	// 不要求签名时，只加载之前没有文件尾的文件
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cut.dat")
+	assert.NoError(t, os.WriteFile(path, cut, 0644))
+	_, err = NewReloader(path, nil, nil)
+	assert.Equal(t, ErrChecksum, err)
+	path = filepath.Join(dir, "old.dat")
+	assert.NoError(t, os.WriteFile(path, old, 0644))
+	r, err := NewReloader(path, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+}
+
+func writeFile(t *testing.T, path string, records []string) {
+	var buf bytes.Buffer
+	b := NewBuilder(4, 2)
+	assert.NoError(t, b.Build(&buf, records, []KeyPair{{Key: uint32Key(1), Idx: 0}, {Key: uint32Key(9), Idx: 0}}))
+	tmp := path + ".tmp"
+	assert.NoError(t, os.WriteFile(tmp, buf.Bytes(), 0644))
+	assert.NoError(t, os.Rename(tmp, path))
+}
+
+func TestReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.dat")
+	writeFile(t, path, []string{"first"})
+	r, err := NewReloader(path, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(r.Version()))
+	_, rec, err := r.Find(uint32Key(5))
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(rec))
+	// 旧版本在释放之前仍然可用
+	old, release := r.Acquire()
+	writeFile(t, path, []string{"second"})
+	assert.NoError(t, r.Reload())
+	_, rec, _ = r.Find(uint32Key(5))
+	assert.Equal(t, "second", string(rec))
+	_, addr := old.SearchIndex(uint32Key(5))
+	rec, err = old.GetRecord(addr)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(rec))
+	release()
+	// 损坏的文件不会替换当前版本
+	data, _ := os.ReadFile(path)
+	data[30] ^= 0xff
+	assert.NoError(t, os.WriteFile(path+".tmp", data, 0644))
+	assert.NoError(t, os.Rename(path+".tmp", path))
+	assert.Equal(t, ErrChecksum, r.Reload())
+	_, rec, _ = r.Find(uint32Key(5))
+	assert.Equal(t, "second", string(rec))
+	// 定期检查
+	reloaded := make(chan string, 1)
+	r.OnReload = func(header *DatHeader, err error) {
+		if err == nil {
+			reloaded <- header.Version
+		}
+	}
+	r.Watch(10 * time.Millisecond)
+	writeFile(t, path, []string{"third"})
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reloaded")
+	}
+	_, rec, _ = r.Find(uint32Key(5))
+	assert.Equal(t, "third", string(rec))
+	assert.NoError(t, r.Close())
+	_, _, err = r.Find(uint32Key(5))
+	assert.NoError(t, err)
+}
+
+// 持有版本时关闭，等待释放期间仍然可以读取头部
+func TestReloaderClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.dat")
+	writeFile(t, path, []string{"first"})
+	r, err := NewReloader(path, nil, nil)
+	assert.NoError(t, err)
+	f, release := r.Acquire()
+	closed := make(chan error, 1)
+	go func() { closed <- r.Close() }()
+	done := make(chan string, 1)
+	go func() {
+		for marked := false; !marked; { // 等Close标记为关闭后再读取
+			time.Sleep(time.Millisecond)
+			r.lock.RLock()
+			marked = r.closed
+			r.lock.RUnlock()
+		}
+		done <- r.Version() + r.Header().Version
+	}()
+	select {
+	case v := <-done:
+		assert.Len(t, v, 16)
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock in Close")
+	}
+	select {
+	case <-closed:
+		t.Fatal("closed before release")
+	default:
+	}
+	key, _ := f.SearchIndex(uint32Key(5)) // 释放之前仍然可用
+	assert.Equal(t, uint32Key(1), key)
+	release()
+	assert.NoError(t, <-closed)
+	assert.NoError(t, r.Close())
+	key, _, err = r.Find(uint32Key(5))
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+	// 关闭之后不再检查
+	r.Watch(time.Millisecond)
+	assert.Nil(t, r.stop)
+	assert.Equal(t, ErrClosed, r.Reload())
+}
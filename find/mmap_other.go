@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package find
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+func mmapFile(fp *os.File) ([]byte, error) {
+	return nil, errors.New("mmap is not supported")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package find
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+// 只读映射整个文件，多个进程可以共用页缓存
+func mmapFile(fp *os.File) ([]byte, error) {
+	info, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return syscall.Mmap(int(fp.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
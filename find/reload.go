@@ -0,0 +1,205 @@
+package find
+
+import (
+	"crypto/ed25519"
+	"os"
+	"sync"
+	"time"
+)
+
+// 一个已加载的版本，引用都释放后才关闭
+type finderHandle struct {
+	finder *Finder
+	refs   sync.WaitGroup
+}
+
+func (h *finderHandle) retire() {
+	go func() {
+		h.refs.Wait()
+		h.finder.Close()
+	}()
+}
+
+// 自动重新加载的Finder，文件更新后打开并检查新版本，再替换旧版本
+// 新的查找使用新版本，旧版本在进行中的查找结束后关闭
+// 更新时先写入临时文件再改名，不要直接修改正在使用（内存映射）的文件
+type Reloader struct {
+	path     string
+	opener   func(path string) (*Finder, error)
+	pubKey   ed25519.PublicKey
+	current  *finderHandle
+	lastSize int64 // 最后一次尝试加载的文件
+	lastTime time.Time
+	closed   bool
+	lock     sync.RWMutex
+	loading  sync.Mutex
+	stop     chan struct{}
+	OnReload func(header *DatHeader, err error) // 每次重新加载后调用，可用于记录日志
+}
+
+// opener为空时使用OpenMmap，pubKey不为空时要求文件有正确的签名
+func NewReloader(path string, opener func(path string) (*Finder, error),
+	pubKey ed25519.PublicKey) (*Reloader, error) {
+	if opener == nil {
+		opener = OpenMmap
+	}
+	r := &Reloader{path: path, opener: opener, pubKey: pubKey}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 打开并检查文件，没有校验和的文件只在不要求签名时可以使用
+// 有文件尾标记但被截断的文件返回ErrChecksum，不会被加载
+func (r *Reloader) load() (*finderHandle, error) {
+	f, err := r.opener(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Verify(r.pubKey); err == ErrNoChecksum && r.pubKey == nil {
+		err = nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &finderHandle{finder: f}, nil
+}
+
+// 立即重新加载，失败时继续使用当前版本
+func (r *Reloader) Reload() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return r.notify(nil, err)
+	}
+	return r.reload(info)
+}
+
+func (r *Reloader) reload(info os.FileInfo) error {
+	r.loading.Lock()
+	defer r.loading.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	r.lastSize, r.lastTime = info.Size(), info.ModTime()
+	h, err := r.load()
+	if err != nil {
+		return r.notify(nil, err)
+	}
+	r.lock.Lock()
+	old := r.current
+	r.current = h
+	r.lock.Unlock()
+	if old != nil {
+		old.retire()
+	}
+	return r.notify(h.finder.Header, nil)
+}
+
+func (r *Reloader) notify(header *DatHeader, err error) error {
+	if r.OnReload != nil {
+		r.OnReload(header, err)
+	}
+	return err
+}
+
+// 文件的大小或修改时间变化时重新加载，加载失败的文件再次变化后才重试
+func (r *Reloader) Check() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	r.loading.Lock()
+	changed := info.Size() != r.lastSize || !info.ModTime().Equal(r.lastTime)
+	r.loading.Unlock()
+	if !changed {
+		return nil
+	}
+	return r.reload(info)
+}
+
+// 定期检查文件，直到调用Close，关闭后不再检查
+func (r *Reloader) Watch(interval time.Duration) {
+	r.lock.Lock()
+	if r.stop != nil || r.closed {
+		r.lock.Unlock()
+		return
+	}
+	r.stop = make(chan struct{})
+	stop := r.stop
+	r.lock.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				r.Check()
+			}
+		}
+	}()
+}
+
+// 取得当前版本，用完后必须调用release，之前不会关闭这个版本
+// 关闭之后取得的版本已经或即将关闭，查找没有结果
+func (r *Reloader) Acquire() (*Finder, func()) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	h := r.current
+	if r.closed { // Close正在等待引用释放，不能再增加
+		return h.finder, func() {}
+	}
+	h.refs.Add(1)
+	return h.finder, h.refs.Done
+}
+
+// 当前版本的头部
+func (r *Reloader) Header() *DatHeader {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.current.finder.Header
+}
+
+// 当前版本号
+func (r *Reloader) Version() string {
+	return r.Header().Version
+}
+
+// 查找Key和记录，没有找到时都为nil，结果是复制的，不受重新加载的影响
+func (r *Reloader) Find(target []byte) ([]byte, []byte, error) {
+	f, release := r.Acquire()
+	defer release()
+	key, addr := f.SearchIndex(target)
+	if addr == nil {
+		return nil, nil, nil
+	}
+	rec, err := f.GetRecord(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append([]byte{}, key...), append([]byte{}, rec...), nil
+}
+
+// 停止检查，等待进行中的查找结束后关闭当前版本，之后的查找都没有结果
+// 先标记为关闭再释放锁，持有版本的调用者仍然可以读取头部
+func (r *Reloader) Close() error {
+	r.loading.Lock()
+	r.lock.Lock()
+	closed := r.closed
+	r.closed = true
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	h := r.current
+	r.lock.Unlock()
+	r.loading.Unlock()
+	if closed {
+		return nil
+	}
+	h.refs.Wait()
+	return h.finder.Close()
+}
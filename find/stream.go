@@ -0,0 +1,443 @@
+package find
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/azhai/gozzo-pck/serialize"
+)
+
+const (
+	DEFAULT_RUN_SIZE    = 1 << 20 // 默认在内存中排序的Key个数
+	DEFAULT_MERGE_WIDTH = 64      // 默认每次合并的序列数，也是合并时打开的临时文件数
+	DEFAULT_DEDUP_SIZE  = 1 << 20 // 默认记住的记录摘要个数，约占40MB内存
+)
+
+// Key重复或冲突
+type KeyError struct {
+	Key   []byte
+	Pos   Position // 记录区中的相对位置
+	Other Position
+}
+
+func (e *KeyError) Error() string {
+	if e.Pos == e.Other {
+		return fmt.Sprintf("Duplicate key %x", e.Key)
+	}
+	return fmt.Sprintf("Overlapping key %x for records at %d and %d", e.Key, e.Pos, e.Other)
+}
+
+// 流式组装数据文件，Key不需要排序，超过RunSize时排序后写入临时文件
+// 内存中最多有RunSize个Key、DedupSize个记录摘要和顶层索引
+// 临时文件写完就关闭，合并时最多同时打开MergeWidth个，序列更多时分多轮合并
+type StreamBuilder struct {
+	ItemSize      int                // 定长记录的长度，为0时是变长记录
+	BlockSize     int                // 子索引每块的索引个数，为0时只有顶层索引
+	RunSize       int                // 内存中排序的Key个数
+	MergeWidth    int                // 每次合并的最多序列数
+	DedupSize     int                // 用于去重的记录摘要个数，满了之后的新记录不去重，为负数时不去重
+	SkipDuplicate bool               // 相同的Key和记录只保留一个，否则报错
+	TempDir       string             // 临时文件的目录，为空时使用系统默认
+	Checksum      int                // 校验和的算法，默认CRC32，CHECKSUM_NONE时文件尾中没有校验和
+	SignKey       ed25519.PrivateKey // 签名的私钥，签名时总是使用SHA-256
+	keySize       int
+	positSize     int
+	writer        io.Writer
+	record        *serialize.Object
+	records       *os.File
+	recWriter     *bufio.Writer
+	recSize       int64
+	digests       map[uint64]int64 // 记录摘要对应的相对位置
+	keys          [][]byte         // 还没有写入临时文件的Key和相对位置
+	runs          []string         // 已排序的临时文件
+}
+
+func NewStreamBuilder(w io.Writer, keySize, positSize int) *StreamBuilder {
+	return &StreamBuilder{
+		RunSize:    DEFAULT_RUN_SIZE,
+		MergeWidth: DEFAULT_MERGE_WIDTH,
+		DedupSize:  DEFAULT_DEDUP_SIZE,
+		Checksum:   CHECKSUM_CRC32,
+		keySize:    keySize,
+		positSize:  positSize,
+		writer:     w,
+		digests:    make(map[uint64]int64),
+	}
+}
+
+func (b *StreamBuilder) tempFile(pattern string) (*os.File, error) {
+	return os.CreateTemp(b.TempDir, pattern)
+}
+
+// 添加一条记录，返回它在记录区中的相对位置，用于AddKey
+// 与之前相同的记录返回之前的位置
+func (b *StreamBuilder) AddRecord(text []byte) (Position, error) {
+	if b.ItemSize > 0 && len(text) != b.ItemSize {
+		return 0, fmt.Errorf("The size of record is %d, expect %d", len(text), b.ItemSize)
+	}
+	if b.records == nil {
+		fp, err := b.tempFile("pckfind-*.rec")
+		if err != nil {
+			return 0, err
+		}
+		b.records, b.recWriter = fp, bufio.NewWriter(fp)
+		header := NewDatHeader(b.keySize, b.positSize)
+		header.ItemSize = b.ItemSize
+		b.record = header.NewRecord().Object
+	}
+	rec := &DatRecord{Text: text, Object: b.record}
+	chunk, err := serialize.Serialize(rec)
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	h.Write(chunk)
+	digest := h.Sum64()
+	if pos, ok := b.digests[digest]; ok {
+		same, err := b.sameRecord(pos, chunk)
+		if err != nil || same {
+			return Position(pos), err
+		}
+	}
+	pos := b.recSize
+	if _, err = b.recWriter.Write(chunk); err != nil {
+		return 0, err
+	}
+	// 摘要冲突时只记录第一个，摘要满了之后不再记录
+	if _, ok := b.digests[digest]; !ok && len(b.digests) < b.DedupSize {
+		b.digests[digest] = pos
+	}
+	b.recSize += int64(len(chunk))
+	return Position(pos), nil
+}
+
+// 摘要相同时比较内容
+func (b *StreamBuilder) sameRecord(pos int64, chunk []byte) (bool, error) {
+	if err := b.recWriter.Flush(); err != nil {
+		return false, err
+	}
+	old := make([]byte, len(chunk))
+	if _, err := b.records.ReadAt(old, pos); err != nil && err != io.EOF {
+		return false, err
+	}
+	return bytes.Equal(old, chunk), nil
+}
+
+// 添加一个Key，pos为AddRecord返回的位置
+func (b *StreamBuilder) AddKey(key []byte, pos Position) error {
+	if len(key) != b.keySize {
+		return fmt.Errorf("The size of key %x is %d, expect %d", key, len(key), b.keySize)
+	}
+	if int64(pos) >= b.recSize {
+		return fmt.Errorf("The record position %d of key %x is out of range", pos, key)
+	}
+	entry := make([]byte, b.keySize+8)
+	copy(entry, key)
+	binary.BigEndian.PutUint64(entry[b.keySize:], uint64(pos))
+	b.keys = append(b.keys, entry)
+	if b.RunSize > 0 && len(b.keys) >= b.RunSize {
+		return b.spill()
+	}
+	return nil
+}
+
+func (b *StreamBuilder) sortKeys() {
+	sort.Slice(b.keys, func(i, j int) bool {
+		return bytes.Compare(b.keys[i], b.keys[j]) < 0
+	})
+}
+
+// 排序后写入临时文件，写完就关闭
+func (b *StreamBuilder) spill() error {
+	b.sortKeys()
+	err := b.writeRun(func(w io.Writer) error {
+		for _, entry := range b.keys {
+			if _, err := w.Write(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	b.keys = b.keys[:0]
+	return err
+}
+
+// 创建一个临时文件作为新的序列
+func (b *StreamBuilder) writeRun(write func(w io.Writer) error) error {
+	fp, err := b.tempFile("pckfind-*.run")
+	if err != nil {
+		return err
+	}
+	b.runs = append(b.runs, fp.Name())
+	w := bufio.NewWriter(fp)
+	if err = write(w); err == nil {
+		err = w.Flush()
+	}
+	if e := fp.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// 一个有序序列的当前位置
+type runCursor struct {
+	reader *bufio.Reader
+	entry  []byte
+}
+
+type runHeap []*runCursor
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return bytes.Compare(h[i].entry, h[j].entry) < 0 }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runCursor)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// 按顺序合并多个序列，每个索引调用一次fn
+func (b *StreamBuilder) mergeReaders(readers []io.Reader, fn func(entry []byte) error) error {
+	h := &runHeap{}
+	for _, r := range readers { // 读取每个序列的第一个
+		c := &runCursor{reader: bufio.NewReader(r), entry: make([]byte, b.keySize+8)}
+		if _, err := io.ReadFull(c.reader, c.entry); err == nil {
+			*h = append(*h, c)
+		} else if err != io.EOF {
+			return err
+		}
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		c := (*h)[0]
+		entry := append([]byte{}, c.entry...)
+		if _, err := io.ReadFull(c.reader, c.entry); err == nil {
+			heap.Fix(h, 0)
+		} else if err == io.EOF {
+			heap.Pop(h)
+		} else {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 打开序列并合并，完成后关闭
+func (b *StreamBuilder) mergeRuns(names []string, extra io.Reader, fn func(entry []byte) error) error {
+	var readers []io.Reader
+	if extra != nil {
+		readers = append(readers, extra)
+	}
+	for _, name := range names {
+		fp, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		readers = append(readers, fp)
+	}
+	return b.mergeReaders(readers, fn)
+}
+
+// 序列超过MergeWidth时，每MergeWidth个合并为一个，直到不超过MergeWidth
+func (b *StreamBuilder) reduceRuns() error {
+	width := b.MergeWidth
+	if width < 2 {
+		width = DEFAULT_MERGE_WIDTH
+	}
+	for len(b.runs) > width {
+		runs := b.runs
+		b.runs = nil
+		for i := 0; i < len(runs); i += width {
+			group := runs[i:]
+			if len(group) > width {
+				group = group[:width]
+			}
+			if len(group) == 1 {
+				b.runs = append(b.runs, group[0])
+				continue
+			}
+			err := b.writeRun(func(w io.Writer) error {
+				return b.mergeRuns(group, nil, func(entry []byte) error {
+					_, err := w.Write(entry)
+					return err
+				})
+			})
+			removeFiles(group)
+			if err != nil {
+				b.runs = append(b.runs, runs[i+len(group):]...) // 由Close删除
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func removeFiles(names []string) error {
+	var err error
+	for _, name := range names {
+		if e := os.Remove(name); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 合并所有序列，检查重复的Key，结果写入临时文件，返回Key的个数
+func (b *StreamBuilder) merge(out io.Writer) (int, error) {
+	if err := b.reduceRuns(); err != nil {
+		return 0, err
+	}
+	b.sortKeys()
+	keys := bytes.NewReader(bytes.Join(b.keys, nil))
+	b.keys = nil
+	var (
+		count int
+		last  []byte
+	)
+	err := b.mergeRuns(b.runs, keys, func(entry []byte) error {
+		if last != nil && bytes.Equal(last[:b.keySize], entry[:b.keySize]) {
+			e := &KeyError{
+				Key:   entry[:b.keySize],
+				Pos:   Position(binary.BigEndian.Uint64(last[b.keySize:])),
+				Other: Position(binary.BigEndian.Uint64(entry[b.keySize:])),
+			}
+			if e.Pos != e.Other || !b.SkipDuplicate {
+				return e
+			}
+			return nil
+		}
+		if _, err := out.Write(entry); err != nil {
+			return err
+		}
+		last = entry
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// 删除临时文件，Finish会自动调用，放弃组装时也要调用
+func (b *StreamBuilder) Close() error {
+	err := removeFiles(b.runs)
+	if b.records != nil {
+		b.records.Close()
+		if e := os.Remove(b.records.Name()); e != nil && err == nil {
+			err = e
+		}
+	}
+	b.runs, b.records, b.keys = nil, nil, nil
+	return err
+}
+
+// 写出完整的数据文件：头部、记录区、子索引和顶层索引
+func (b *StreamBuilder) Finish() (err error) {
+	defer func() {
+		if e := b.Close(); err == nil {
+			err = e
+		}
+	}()
+	if b.ItemSize < 0 || b.ItemSize > ITEM_SIZE_MAX {
+		return fmt.Errorf("The item size %d is out of range 0 ~ %d", b.ItemSize, ITEM_SIZE_MAX)
+	}
+	if b.BlockSize < 0 || b.BlockSize > math.MaxUint16 {
+		return fmt.Errorf("The block size %d is out of range 0 ~ %d", b.BlockSize, math.MaxUint16)
+	}
+	if b.recWriter != nil {
+		if err = b.recWriter.Flush(); err != nil {
+			return
+		}
+	}
+	merged, err := b.tempFile("pckfind-*.idx")
+	if err != nil {
+		return
+	}
+	defer os.Remove(merged.Name())
+	defer merged.Close()
+	mw := bufio.NewWriter(merged)
+	count, err := b.merge(mw)
+	if err == nil {
+		err = mw.Flush()
+	}
+	if err != nil {
+		return
+	}
+	format, positSize := ChooseFormat(b.keySize, b.positSize, b.BlockSize, int(b.recSize), count)
+	header := NewFormatHeader(format)
+	header.KeySize, header.PositSize, header.ItemSize = b.keySize, positSize, b.ItemSize
+	header.BlockSize = uint16(b.BlockSize)
+	header.SizeProps = header.GetSizeProps(b.ItemSize)
+	header.KeyCount = uint64(count)
+	header.Version = time.Now().Format("060102") + "00"
+	base := uint64(header.GetHeaderSize())
+	unitSize := uint64(b.keySize + positSize)
+	header.SubBegin = base + uint64(b.recSize)
+	header.IdxBegin = header.SubBegin
+	header.IdxEnd = header.IdxBegin + uint64(count)*unitSize
+	if b.BlockSize > 0 {
+		header.IdxBegin = header.IdxEnd
+		header.IdxEnd += uint64(header.GetBlockCount() * b.keySize)
+	}
+	algo := trailerAlgo(b.Checksum, b.SignKey)
+	h, err := NewChecksum(algo)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(io.MultiWriter(b.writer, h))
+	header.Trailer = true
+	restore := header.markTrailer()
+	_, err = serialize.SerializeTo(w, header)
+	restore()
+	if err != nil {
+		return
+	}
+	if b.records != nil {
+		if _, err = b.records.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = io.Copy(w, b.records); err != nil {
+			return
+		}
+	}
+	if _, err = merged.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	var (
+		top    []byte
+		posit  = serialize.NewUnsigned(positSize)
+		reader = bufio.NewReader(merged)
+		entry  = make([]byte, b.keySize+8)
+	)
+	for i := 0; i < count; i++ {
+		if _, err = io.ReadFull(reader, entry); err != nil {
+			return
+		}
+		key := entry[:b.keySize]
+		pos := base + binary.BigEndian.Uint64(entry[b.keySize:])
+		w.Write(key)
+		w.Write(posit.EncodeUint64(pos))
+		if b.BlockSize > 0 && i%b.BlockSize == 0 { // 每块的第一个Key
+			top = append(top, key...)
+		}
+	}
+	w.Write(top)
+	if err = w.Flush(); err != nil {
+		return
+	}
+	return WriteTrailer(b.writer, algo, h, b.SignKey)
+}
@@ -5,4 +5,5 @@ replace golang.org/x/sys => github.com/golang/sys v0.0.0-20190813064441-fde4db37
 require (
 	github.com/azhai/gozzo-utils v0.3.3
 	github.com/stretchr/testify v1.4.0
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -1,17 +1,25 @@
 package match
 
 import (
+	"bytes"
 	"fmt"
-
-	"github.com/azhai/gozzo-utils/common"
+	"io"
 )
 
+//计算不定长段的实际长度，data从段的开始位置算起，返回<0表示数据不完整
+type MeasureFunc func(data []byte) int
+
 //段，若干个byte组成
+//Optional：开头的可选段只能是最后几个段，数据不够时视为不存在，组装时没有值就跳过；
+//结尾的可选段不缩减未知部分；可选段都不计入最小长度。
+//之前的版本中开头的可选段也不缩减未知部分，后面的段与它重叠，现在按顺序排在它之后
 type Field struct {
-	Size     int  //长度>=0
-	Optional bool //可选或不定长度（非固定）
-	Start    int  //开始位置（包含），可能为负
-	Stop     int  //结束位置（不包含），可能为负
+	Size      int         //长度>=0
+	Optional  bool        //可选，见上面的说明
+	AlignLeft bool        //数据靠左，长度不足时在右边补位，如定长文本
+	Start     int         //开始位置（包含），可能为负
+	Stop      int         //结束位置（不包含），可能为负
+	Measure   MeasureFunc //不定长段的长度，只能用于开头的段
 }
 
 func NewField(size int, optional bool) *Field {
@@ -26,6 +34,13 @@ func NewField(size int, optional bool) *Field {
 	}
 }
 
+//不定长的段，如varint，Size为最小长度
+func NewVarField(size int, measure MeasureFunc) *Field {
+	field := NewField(size, false)
+	field.Measure = measure
+	return field
+}
+
 //找出段的正向起止位置，offset为修正值，只对同符号数据起作用
 func (field *Field) GetRange(offset int) (int, int) {
 	var (
@@ -79,6 +94,22 @@ func (m *FieldMatcher) AddFixeds(sizes []int, names []string) {
 	}
 }
 
+//复制一份，之后添加的段互不影响
+func (m *FieldMatcher) Clone() *FieldMatcher {
+	rest := *m.rest
+	c := &FieldMatcher{
+		rest:     &rest,
+		fields:   make(map[string]*Field),
+		Sequence: append([]string{}, m.Sequence...),
+		Reverse:  append([]string{}, m.Reverse...),
+	}
+	for name, field := range m.fields {
+		f := *field
+		c.fields[name] = &f
+	}
+	return c
+}
+
 //添加开头的段定义，要求field.Start >= 0
 func (m *FieldMatcher) AddField(name string, field *Field) *Field {
 	if field.Start < 0 {
@@ -88,11 +119,12 @@ func (m *FieldMatcher) AddField(name string, field *Field) *Field {
 		name = fmt.Sprintf("+%d", len(m.Sequence))
 	}
 	field.Start += m.rest.Start
-	if field.Size > 0 {
+	if field.Measure != nil { //不定长，后面的段在匹配时修正位置
 		field.Stop = field.Start + field.Size
-		if !field.Optional { //增加固定字段时，缩减未知部分的范围
-			m.rest.Start = field.Stop
-		}
+		m.rest.Start = field.Stop
+	} else if field.Size > 0 { //增加固定字段时，缩减未知部分的范围
+		field.Stop = field.Start + field.Size
+		m.rest.Start = field.Stop
 	}
 	m.Sequence = append(m.Sequence, name)
 	m.fields[name] = field
@@ -122,51 +154,270 @@ func (m *FieldMatcher) AddRevField(name string, field *Field) *Field {
 func (m *FieldMatcher) GetLeastSize() (int, int) {
 	var least = 0
 	for _, f := range m.fields {
-		least += f.Size
+		if !f.Optional { //可选的段不计算在内
+			least += f.Size
+		}
 	}
 	return len(m.fields), least
 }
 
-// 按字节位置匹配
-func (m *FieldMatcher) Match(chunk []byte, withRest bool) (map[string][]byte, error) {
+// 段在数据中的正向起止位置
+type Range struct {
+	Start int
+	Stop  int
+}
+
+// 数据长度不够
+type ShortError struct {
+	Name   string //第一个超出范围的段
+	Offset int    //这个段的开始位置
+	Size   int    //数据长度
+	Least  int    //至少需要的长度
+}
+
+func (e *ShortError) Error() string {
+	tpl := "The length of data is %d, little than %d"
+	return fmt.Sprintf(tpl, e.Size, e.Least)
+}
+
+//按在数据中的位置排列的段名，rest在开头段和结尾段之间
+func (m *FieldMatcher) Names() []string {
+	names := append(append([]string{}, m.Sequence...), "rest")
+	for i := len(m.Reverse) - 1; i >= 0; i-- { //结尾段是从后往前添加的
+		names = append(names, m.Reverse[i])
+	}
+	return names
+}
+
+//段的定义，rest为未识别部分
+func (m *FieldMatcher) GetField(name string) *Field {
+	if name == "rest" {
+		return m.rest
+	}
+	return m.fields[name]
+}
+
+//找出第一个超出范围的段
+func (m *FieldMatcher) shortError(size, least int) *ShortError {
+	err := &ShortError{Name: "rest", Size: size, Least: least}
+	for _, name := range m.Sequence {
+		if field := m.fields[name]; field.Stop > size {
+			err.Name, err.Offset = name, field.Start
+			return err
+		}
+	}
+	if count := len(m.Reverse); count > 0 {
+		err.Name = m.Reverse[count-1]
+	}
+	return err
+}
+
+// 按顺序计算开头各段的位置，visit返回false时停止
+// 返回不定长段造成的修正值，以及第一个不存在的可选段的位置
+func (m *FieldMatcher) walk(chunk []byte, visit func(name string, r Range) bool) (int, int, error) {
+	size := len(chunk)
+	start, stop, offset, absent := 0, 0, 0, -1
+	for _, name := range m.Sequence { // 按顺序
+		field := m.fields[name]
+		start, stop = field.GetRange(offset)
+		if field.Optional && (absent >= 0 || stop-m.rest.Stop > size) {
+			if absent < 0 { //之后的可选段都不存在
+				absent = start
+			}
+			continue
+		} else if absent >= 0 {
+			return 0, 0, &ShortError{Name: name, Offset: start, Size: size, Least: stop - m.rest.Stop}
+		}
+		if field.Measure != nil {
+			n := -1
+			if start <= size {
+				n = field.Measure(chunk[start:])
+			}
+			if n < 0 || start+n > size {
+				least := start + field.Size + 1
+				return 0, 0, &ShortError{Name: name, Offset: start, Size: size, Least: least}
+			}
+			stop = start + n
+			offset += n - field.Size
+		} else if field.Size == 0 { //长度为0时直到数据结尾
+			stop = size
+		}
+		if stop > size {
+			return 0, 0, &ShortError{Name: name, Offset: start, Size: size, Least: stop}
+		}
+		if !visit(name, Range{Start: start, Stop: stop}) {
+			break
+		}
+	}
+	return offset, absent, nil
+}
+
+// 结尾段的位置
+func (m *FieldMatcher) reverseRange(name string, size int) Range {
+	start, stop := m.fields[name].GetRange(0)
+	if start < 0 {
+		start += size
+	}
+	if stop <= 0 {
+		stop += size
+	}
+	return Range{Start: start, Stop: stop}
+}
+
+// 未识别部分的位置
+func (m *FieldMatcher) restRange(size, offset, absent int) (Range, error) {
+	start, stop := m.rest.GetRange(0)
+	if start += offset; absent >= 0 {
+		start = absent
+	}
+	if stop+size < start {
+		least := start - stop
+		return Range{}, &ShortError{Name: "rest", Offset: start, Size: size, Least: least}
+	}
+	return Range{Start: start, Stop: stop + size}, nil
+}
+
+// 计算各段的起止位置，不定长段之后的位置需要修正
+func (m *FieldMatcher) Ranges(chunk []byte, withRest bool) (map[string]Range, error) {
 	size := len(chunk)
 	if _, least := m.GetLeastSize(); size < least {
-		tpl := "The length of data is %d, little than %d"
-		return nil, fmt.Errorf(tpl, size, least)
+		return nil, m.shortError(size, least)
 	}
-	start, stop := 0, 0
-	data := make(map[string][]byte)
-	for name, field := range m.fields {
-		start, stop = field.GetRange(0) // 一定不为负
-		data[name] = common.GetSlice(chunk, start, stop, size)
+	ranges := make(map[string]Range)
+	offset, absent, err := m.walk(chunk, func(name string, r Range) bool {
+		ranges[name] = r
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range m.Reverse {
+		ranges[name] = m.reverseRange(name, size)
+	}
+	rest, err := m.restRange(size, offset, absent)
+	if err != nil {
+		return nil, err
 	}
 	if withRest {
-		start, stop = m.rest.GetRange(0) // 一定不为负
-		data["rest"] = common.GetSlice(chunk, start, stop, size)
+		ranges["rest"] = rest
+	}
+	return ranges, nil
+}
+
+// 只计算一个段的位置，之后的段不测量，段不存在时返回false
+func (m *FieldMatcher) RangeOf(chunk []byte, name string) (Range, bool, error) {
+	size := len(chunk)
+	if _, least := m.GetLeastSize(); size < least {
+		return Range{}, false, m.shortError(size, least)
+	}
+	field, ok := m.fields[name]
+	if ok && field.Start < 0 {
+		return m.reverseRange(name, size), true, nil
+	} else if !ok && name != "rest" {
+		return Range{}, false, nil
+	}
+	var (
+		result Range
+		found  bool
+	)
+	offset, absent, err := m.walk(chunk, func(key string, r Range) bool {
+		if key == name {
+			result, found = r, true
+		}
+		return !found
+	})
+	if err != nil || name != "rest" {
+		return result, found, err
+	}
+	result, err = m.restRange(size, offset, absent)
+	return result, err == nil, err
+}
+
+// 按字节位置匹配
+func (m *FieldMatcher) Match(chunk []byte, withRest bool) (map[string][]byte, error) {
+	ranges, err := m.Ranges(chunk, withRest)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string][]byte)
+	for name, r := range ranges {
+		data[name] = chunk[r.Start:r.Stop]
 	}
 	return data, nil
 }
 
+// 数据中开头各段占用的长度，有结尾段时为全部数据，不完整时返回-1
+func (m *FieldMatcher) Measure(chunk []byte) int {
+	if len(m.Reverse) > 0 {
+		return len(chunk)
+	}
+	ranges, err := m.Ranges(chunk, false)
+	if err != nil {
+		return -1
+	}
+	size := 0
+	for _, r := range ranges {
+		if r.Stop > size {
+			size = r.Stop
+		}
+	}
+	return size
+}
+
+// 调整到n字节，靠左时在右边补0、超长时保留开头，否则在左边补0、超长时保留结尾
+func FitBytes(data []byte, alignLeft bool, n int) []byte {
+	if len(data) == n {
+		return data
+	}
+	chunk := make([]byte, n)
+	if alignLeft {
+		copy(chunk, data)
+	} else if len(data) > n {
+		copy(chunk, data[len(data)-n:])
+	} else {
+		copy(chunk[n-len(data):], data)
+	}
+	return chunk
+}
+
 // 放到对应位置组装
 func (m *FieldMatcher) Build(data map[string][]byte) []byte {
+	var buf bytes.Buffer
+	m.BuildTo(&buf, data)
+	return buf.Bytes()
+}
+
+// 按顺序逐段写入，不组装完整的数据，返回写入的字节数
+func (m *FieldMatcher) BuildTo(w io.Writer, data map[string][]byte) (int, error) {
 	var (
-		field        *Field
-		ok           bool
-		chunk, value []byte
+		field *Field
+		ok    bool
+		value []byte
+		total int
 	)
-	names := append(m.Sequence, "rest")
-	names = append(names, m.Reverse...)
-	for _, name := range names {
-		if field, ok = m.fields[name]; !ok {
+	last := -1 //最后一个有值的开头可选段，之前没有值的可选段要补位
+	for i, name := range m.Sequence {
+		if _, ok = data[name]; ok && m.fields[name].Optional {
+			last = i
+		}
+	}
+	for i, name := range m.Names() {
+		if field, ok = m.fields[name]; !ok && name != "rest" {
 			continue
 		}
 		if value, ok = data[name]; !ok {
+			if field != nil && field.Optional && i > last { //不存在的可选段
+				continue
+			}
 			value = nil
 		}
-		if field.Size > 0 {
-			value = common.ResizeBytes(value, true, field.Size)
+		if field != nil && field.Size > 0 && field.Measure == nil {
+			value = FitBytes(value, field.AlignLeft, field.Size)
+		}
+		n, err := w.Write(value)
+		if total += n; err != nil {
+			return total, err
 		}
-		chunk = append(chunk, value...)
 	}
-	return chunk
+	return total, nil
 }
@@ -29,8 +29,8 @@ func CreateSplitMatcher(start, end []byte) *SplitMatcher {
 }
 
 func MatchChunk(chunk []byte, fm *FieldMatcher) (cmd string) {
-	data := fm.Match(chunk, true)
-	if len(data) >= 7 {
+	data, err := fm.Match(chunk, true)
+	if err == nil && len(data) >= 7 {
 		cmd = string(data["cmd"])
 	}
 	return
@@ -132,3 +132,90 @@ func BenchmarkMatch(b *testing.B) {
 		}
 	}
 }
+
+// 测试只计算一个段的位置
+func TestRangeOf(t *testing.T) {
+	m := NewFieldMatcher()
+	m.AddField("head", NewField(1, false))
+	m.AddField("code", NewField(2, false))
+	m.AddField("body", NewVarField(1, func(data []byte) int {
+		return int(data[0]) + 1
+	}))
+	m.AddField("seqno", NewField(2, false))
+	m.AddRevField("tail", NewField(-1, false))
+	chunk := []byte{0x7e, 0x01, 0x02, 0x02, 0xaa, 0xbb, 0x00, 0x09, 0xcc, 0x7e}
+	r, found, err := m.RangeOf(chunk, "code")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, Range{Start: 1, Stop: 3}, r)
+	r, _, _ = m.RangeOf(chunk, "seqno")
+	assert.Equal(t, Range{Start: 6, Stop: 8}, r)
+	r, _, _ = m.RangeOf(chunk, "tail")
+	assert.Equal(t, Range{Start: 9, Stop: 10}, r)
+	r, _, _ = m.RangeOf(chunk, "rest")
+	assert.Equal(t, Range{Start: 8, Stop: 9}, r)
+	_, found, err = m.RangeOf(chunk, "check")
+	assert.NoError(t, err)
+	assert.False(t, found)
+	ranges, err := m.Ranges(chunk, true)
+	assert.NoError(t, err)
+	assert.Len(t, ranges, 6)
+}
+
+// 测试定长段的补位和截断
+func TestFitBytes(t *testing.T) {
+	assert.Equal(t, []byte("AB\x00\x00"), FitBytes([]byte("AB"), true, 4))
+	assert.Equal(t, []byte("ABCD"), FitBytes([]byte("ABCDEFGH"), true, 4))
+	assert.Equal(t, []byte("\x00\x00AB"), FitBytes([]byte("AB"), false, 4))
+	assert.Equal(t, []byte("EFGH"), FitBytes([]byte("ABCDEFGH"), false, 4))
+	m := NewFieldMatcher()
+	text := NewField(6, false)
+	text.AlignLeft = true
+	m.AddField("text", text)
+	m.AddField("code", NewField(2, false))
+	chunk := m.Build(map[string][]byte{"text": []byte("ABCDEFGH"), "code": []byte("XY")})
+	assert.Equal(t, []byte("ABCDEFXY"), chunk)
+}
+
+// 测试结尾段的顺序：后添加的在前面，组装时要按在数据中的位置
+func TestNamesOrder(t *testing.T) {
+	m := NewFieldMatcher()
+	m.AddField("head", NewField(1, false))
+	m.AddRevField("tail", NewField(-1, false))
+	m.AddRevField("check", NewField(-1, false))
+	assert.Equal(t, []string{"head", "rest", "check", "tail"}, m.Names())
+	data := map[string][]byte{
+		"head": {0x7e}, "rest": {0x01, 0x02}, "check": {0xcc}, "tail": {0x7f},
+	}
+	chunk := m.Build(data)
+	assert.Equal(t, []byte{0x7e, 0x01, 0x02, 0xcc, 0x7f}, chunk)
+	result, err := m.Match(chunk, true)
+	assert.NoError(t, err)
+	assert.Equal(t, data, result)
+}
+
+// 测试开头的可选段：按顺序排在前面的段之后，数据不够时视为不存在
+func TestOptionalField(t *testing.T) {
+	m := NewFieldMatcher()
+	m.AddField("code", NewField(2, false))
+	m.AddField("extra", NewField(2, true))
+	m.AddField("more", NewField(1, true))
+	_, least := m.GetLeastSize()
+	assert.Equal(t, 2, least)
+	result, err := m.Match([]byte{0x01, 0x02, 0x03, 0x04, 0x05}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x03, 0x04}, result["extra"])
+	assert.Equal(t, []byte{0x05}, result["more"])
+	result, err = m.Match([]byte{0x01, 0x02, 0x03, 0x04}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x03, 0x04}, result["extra"])
+	_, ok := result["more"]
+	assert.False(t, ok)
+	result, err = m.Match([]byte{0x01, 0x02}, false)
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+	chunk := m.Build(map[string][]byte{"code": {0x01, 0x02}, "more": {0x05}})
+	assert.Equal(t, []byte{0x01, 0x02, 0x00, 0x00, 0x05}, chunk) // 后面的可选段存在时补位
+	chunk = m.Build(map[string][]byte{"code": {0x01, 0x02}})
+	assert.Equal(t, []byte{0x01, 0x02}, chunk)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/azhai/gozzo-pck/find"
+)
+
+var checksumNames = map[string]int{
+	"none":   find.CHECKSUM_NONE,
+	"crc32":  find.CHECKSUM_CRC32,
+	"sha256": find.CHECKSUM_SHA256,
+}
+
+// 十六进制的私钥或种子，或者保存私钥的文件
+func readPrivateKey(value string) (ed25519.PrivateKey, error) {
+	if data, err := os.ReadFile(value); err == nil {
+		value = string(data)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err == nil && len(key) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(key), nil
+	} else if err == nil && len(key) == ed25519.PrivateKeySize {
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, fmt.Errorf("Invalid private key in %s", value)
+}
+
+// 生成签名用的密钥，写入PREFIX.key和PREFIX.pub
+func runKeygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	prefix := flags.Arg(0)
+	if err = os.WriteFile(prefix+".key", []byte(hex.EncodeToString(priv.Seed())+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(prefix+".pub", []byte(hex.EncodeToString(pub)+"\n"), 0644)
+}
+
+// 读取TSV生成数据文件，每行一个Key和记录，相同的记录只保存一次
+func runBuild(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	output := flags.String("o", "", "output dat file (required)")
+	keySize := flags.Int("key-size", 4, "size of keys in bytes")
+	keyEnc := flags.String("key-encoding", "hex", "encoding of keys: "+strings.Join(keyEncodings, ", "))
+	keyCol := flags.Int("key-col", 1, "column of keys, starting from 1")
+	recCol := flags.Int("record-col", 2, "column of records, 0 for the rest of the line after the key")
+	sep := flags.String("sep", "\t", "column separator")
+	positSize := flags.Int("posit-size", 4, "size of record positions, widened automatically for large files")
+	itemSize := flags.Int("item-size", 0, "size of fixed records, 0 for variable records")
+	blockSize := flags.Int("block-size", 0, "keys per subset index block, 0 for a flat index")
+	checksum := flags.String("checksum", "crc32", "checksum algorithm: none, crc32, sha256")
+	signKey := flags.String("sign-key", "", "ed25519 private key in hex, or the file containing it")
+	skipDup := flags.Bool("skip-dup", false, "skip duplicate lines instead of failing")
+	tempDir := flags.String("temp-dir", "", "directory for temporary files")
+	flags.Parse(args)
+	if *output == "" || flags.NArg() > 1 {
+		return errUsage
+	}
+	if err := checkEncoding(*keyEnc); err != nil {
+		return err
+	}
+	if *keyCol < 1 || *recCol < 0 || *recCol == *keyCol {
+		return fmt.Errorf("Invalid key column %d or record column %d", *keyCol, *recCol)
+	}
+	algo, ok := checksumNames[*checksum]
+	if !ok {
+		return fmt.Errorf("Unknown checksum algorithm %s", *checksum)
+	}
+
+	input := io.Reader(os.Stdin)
+	if fpath := flags.Arg(0); fpath != "" && fpath != "-" {
+		fp, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		input = fp
+	}
+	// 先写入临时文件再改名，正在使用的旧文件不受影响
+	out, err := os.CreateTemp(filepath.Dir(*output), filepath.Base(*output)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	b := find.NewStreamBuilder(w, *keySize, *positSize)
+	b.ItemSize, b.BlockSize, b.Checksum = *itemSize, *blockSize, algo
+	b.SkipDuplicate, b.TempDir = *skipDup, *tempDir
+	if *signKey != "" {
+		if b.SignKey, err = readPrivateKey(*signKey); err != nil {
+			return err
+		}
+	}
+	defer b.Close()
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" || strings.HasPrefix(text, "#") { // 空行和注释
+			continue
+		}
+		if err = addLine(b, text, *sep, *keyCol, *recCol, *keyEnc, *keySize); err != nil {
+			return fmt.Errorf("Line %d: %w", line, err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if err = b.Finish(); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(out.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), *output)
+}
+
+func addLine(b *find.StreamBuilder, text, sep string, keyCol, recCol int, enc string, keySize int) error {
+	cols := strings.Split(text, sep)
+	if len(cols) < keyCol || len(cols) < recCol {
+		return fmt.Errorf("Expect at least %d columns, got %d", maxInt(keyCol, recCol), len(cols))
+	}
+	key, err := encodeKey(enc, cols[keyCol-1], keySize)
+	if err != nil {
+		return err
+	}
+	var record string
+	if recCol > 0 {
+		record = unquoteText(cols[recCol-1])
+	} else {
+		record = strings.Join(cols[keyCol:], sep)
+	}
+	pos, err := b.AddRecord([]byte(record))
+	if err != nil {
+		return err
+	}
+	return b.AddKey(key, pos)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
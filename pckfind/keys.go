@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/azhai/gozzo-pck/serialize"
+)
+
+// Key的文本编码
+var keyEncodings = []string{"hex", "string", "uint", "ip", "bcd"}
+
+func checkEncoding(enc string) error {
+	for _, name := range keyEncodings {
+		if name == enc {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown key encoding %s, expect one of %s",
+		enc, strings.Join(keyEncodings, ", "))
+}
+
+// 文本转为size字节的Key
+// hex: 十六进制，长度必须一致
+// string: 原样，不足时右边补0
+// uint: 十进制整数，大端序
+// ip: IPv4为4字节，IPv6为16字节
+// bcd: 数字串按BCD压缩，不足时右边补0，例如手机号段
+func encodeKey(enc, text string, size int) ([]byte, error) {
+	var (
+		key []byte
+		err error
+	)
+	switch enc {
+	case "hex":
+		key, err = hex.DecodeString(text)
+	case "string":
+		if len(text) > size {
+			return nil, fmt.Errorf("The key %q is longer than %d bytes", text, size)
+		}
+		key = make([]byte, size)
+		copy(key, text)
+	case "uint":
+		var n uint64
+		if n, err = strconv.ParseUint(text, 10, 64); err != nil {
+			break
+		}
+		if size < 8 && n>>(uint(size)*8) != 0 {
+			return nil, fmt.Errorf("The key %s overflows %d bytes", text, size)
+		}
+		key = serialize.NewUnsigned(size).EncodeUint64(n)
+	case "ip":
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address %s", text)
+		}
+		if size == net.IPv4len {
+			ip = ip.To4()
+		}
+		key = []byte(ip)
+	case "bcd":
+		if len(text) > size*2 || strings.Trim(text, "0123456789") != "" {
+			return nil, fmt.Errorf("The key %s is not a number of at most %d digits", text, size*2)
+		}
+		key, err = hex.DecodeString(text + strings.Repeat("0", size*2-len(text)))
+	default:
+		return nil, checkEncoding(enc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s key %s: %w", enc, text, err)
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("The size of key %s is %d, expect %d", text, len(key), size)
+	}
+	return key, nil
+}
+
+// Key转为文本，与encodeKey相反，bcd保留补齐的0
+func decodeKey(enc string, key []byte) string {
+	switch enc {
+	case "string":
+		return quoteText(strings.TrimRight(string(key), "\x00"))
+	case "uint":
+		if len(key) <= 8 {
+			n := serialize.NewUnsigned(len(key)).DecodeUint64(key)
+			return strconv.FormatUint(n, 10)
+		}
+	case "ip":
+		if len(key) == net.IPv4len || len(key) == net.IPv6len {
+			return net.IP(key).String()
+		}
+	}
+	return hex.EncodeToString(key)
+}
+
+// 有控制字符或不是UTF-8的文本，使用Go的引号格式，保证每行一个字段
+func quoteText(text string) string {
+	if !utf8.ValidString(text) || strings.HasPrefix(text, "\"") ||
+		strings.IndexFunc(text, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+		return strconv.Quote(text)
+	}
+	return text
+}
+
+// quoteText的逆操作
+func unquoteText(text string) string {
+	if strings.HasPrefix(text, "\"") {
+		if s, err := strconv.Unquote(text); err == nil {
+			return s
+		}
+	}
+	return text
+}
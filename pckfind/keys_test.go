@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyEncoding(t *testing.T) {
+	cases := []struct {
+		enc, text string
+		size      int
+		key       []byte
+		decoded   string
+	}{
+		{"hex", "0a0b", 2, []byte{0x0a, 0x0b}, "0a0b"},
+		{"string", "ab", 4, []byte{'a', 'b', 0, 0}, "ab"},
+		{"uint", "258", 3, []byte{0, 1, 2}, "258"},
+		{"ip", "10.1.2.3", 4, []byte{10, 1, 2, 3}, "10.1.2.3"},
+		{"bcd", "130", 3, []byte{0x13, 0x00, 0x00}, "130000"},
+	}
+	for _, c := range cases {
+		key, err := encodeKey(c.enc, c.text, c.size)
+		assert.NoError(t, err)
+		assert.Equal(t, c.key, key)
+		assert.Equal(t, c.decoded, decodeKey(c.enc, key))
+	}
+	for _, c := range [][2]string{{"hex", "0a"}, {"string", "abcde"}, {"uint", "65536"},
+		{"ip", "::1"}, {"bcd", "12a"}, {"base64", "AA=="}} {
+		_, err := encodeKey(c[0], c[1], 2)
+		assert.Error(t, err, c[0])
+	}
+}
+
+func TestQuoteText(t *testing.T) {
+	for _, text := range []string{"plain", "tab\there", "\"quoted\"", "\xff\x00"} {
+		assert.Equal(t, text, unquoteText(quoteText(text)))
+	}
+	assert.Equal(t, "plain", quoteText("plain"))
+	assert.Equal(t, `"tab\there"`, quoteText("tab\there"))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/azhai/gozzo-pck/find"
+)
+
+// 参数不正确，显示命令的用法
+var errUsage = errors.New("Invalid arguments")
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"build":  {"-o OUTPUT [-key-size N] [-key-encoding ENC] [-key-col N] [-record-col N] [OPTIONS] [INPUT.tsv]", runBuild},
+	"query":  {"[-key-encoding ENC] [-format tsv|json] FILE [KEY...]", runQuery},
+	"dump":   {"[-key-encoding ENC] [-format tsv|json] FILE", runDump},
+	"stats":  {"FILE", runStats},
+	"verify": {"[-pubkey HEX|FILE] FILE...", runVerify},
+	"keygen": {"PREFIX", runKeygen},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: pckfind COMMAND [OPTIONS]")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  pckfind %s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "Run 'pckfind COMMAND -h' for the options of a command")
+}
+
+// 十六进制的公钥，或者保存公钥的文件
+func readPublicKey(value string) (ed25519.PublicKey, error) {
+	if data, err := os.ReadFile(value); err == nil {
+		value = string(data)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid public key %s", value)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// 检查校验和与签名，有文件不完整时返回错误
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	pubkey := flags.String("pubkey", "", "ed25519 public key in hex, or the file containing it")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errUsage
+	}
+	var (
+		key    ed25519.PublicKey
+		err    error
+		failed int
+	)
+	if *pubkey != "" {
+		if key, err = readPublicKey(*pubkey); err != nil {
+			return err
+		}
+	}
+	for _, fpath := range flags.Args() {
+		if err = verifyFile(fpath, key); err != nil {
+			fmt.Printf("%s: %s\n", fpath, err)
+			failed++
+		} else {
+			fmt.Printf("%s: OK\n", fpath)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, flags.NArg())
+	}
+	return nil
+}
+
+func verifyFile(fpath string, key ed25519.PublicKey) error {
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return find.Verify(fp, key)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err == errUsage {
+		fmt.Fprintf(os.Stderr, "Usage: pckfind %s %s\n", os.Args[1], cmd.usage)
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 运行命令，返回写到标准输出的内容
+func runCommand(t *testing.T, name string, args ...string) (string, error) {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	err = commands[name].run(args)
+	w.Close()
+	os.Stdout = stdout
+	return <-output, err
+}
+
+const buildInput = `# Key和记录
+5	"tab\there"
+1	one
+9	nine
+`
+
+func TestBuildQuery(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.tsv")
+	assert.NoError(t, os.WriteFile(input, []byte(buildInput), 0644))
+	dat := filepath.Join(dir, "test.dat")
+	_, err := runCommand(t, "build", "-o", dat, "-key-encoding", "uint", input)
+	assert.NoError(t, err)
+
+	// 最后一个Key也可以找到，大于它时没有结果
+	out, err := runCommand(t, "query", "-key-encoding", "uint", dat, "1", "4", "9", "10")
+	assert.EqualError(t, err, "1 of 4 keys not found")
+	assert.Equal(t, "1\t1\tone\n4\t1\tone\n9\t9\tnine\n10\n", out)
+	out, err = runCommand(t, "query", "-key-encoding", "uint", "-format", "json", dat, "5")
+	assert.NoError(t, err)
+	var obj map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(out), &obj))
+	assert.Equal(t, map[string]interface{}{
+		"query": "5", "found": true, "key": "5", "record": "tab\there",
+	}, obj)
+
+	// dump的输出可以再生成相同的数据文件
+	out, err = runCommand(t, "dump", "-key-encoding", "uint", dat)
+	assert.NoError(t, err)
+	assert.Equal(t, "1\tone\n5\t\"tab\\there\"\n9\tnine\n", out)
+	dumped := filepath.Join(dir, "dump.tsv")
+	assert.NoError(t, os.WriteFile(dumped, []byte(out), 0644))
+	again := filepath.Join(dir, "again.dat")
+	_, err = runCommand(t, "build", "-o", again, "-key-encoding", "uint", dumped)
+	assert.NoError(t, err)
+	out2, err := runCommand(t, "dump", "-key-encoding", "uint", again)
+	assert.NoError(t, err)
+	assert.Equal(t, out, out2)
+
+	out, err = runCommand(t, "stats", dat)
+	assert.NoError(t, err)
+	assert.Regexp(t, `(?m)^key count:\s+3$`, out)
+	assert.Regexp(t, `(?m)^record count:\s+3$`, out)
+	assert.Regexp(t, `(?m)^checksum:\s+crc32$`, out)
+	out, err = runCommand(t, "verify", dat)
+	assert.NoError(t, err)
+	assert.Equal(t, dat+": OK\n", out)
+
+	// 参数不正确
+	for _, name := range []string{"query", "dump", "stats", "verify"} {
+		_, err = runCommand(t, name)
+		assert.Equal(t, errUsage, err, name)
+	}
+	_, err = runCommand(t, "build", input)
+	assert.Equal(t, errUsage, err)
+}
+
+func TestSignedBuild(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.tsv")
+	assert.NoError(t, os.WriteFile(input, []byte(buildInput), 0644))
+	prefix := filepath.Join(dir, "sign")
+	_, err := runCommand(t, "keygen", prefix)
+	assert.NoError(t, err)
+	dat := filepath.Join(dir, "signed.dat")
+	_, err = runCommand(t, "build", "-o", dat, "-key-encoding", "uint", "-sign-key", prefix+".key", input)
+	assert.NoError(t, err)
+	out, err := runCommand(t, "verify", "-pubkey", prefix+".pub", dat)
+	assert.NoError(t, err)
+	assert.Equal(t, dat+": OK\n", out)
+	out, err = runCommand(t, "stats", dat)
+	assert.NoError(t, err)
+	assert.Regexp(t, `(?m)^checksum:\s+sha256, signed$`, out)
+
+	// 截断的文件
+	data, _ := os.ReadFile(dat)
+	assert.NoError(t, os.WriteFile(dat, data[:len(data)-1], 0644))
+	out, err = runCommand(t, "verify", "-pubkey", prefix+".pub", dat)
+	assert.EqualError(t, err, "1 of 1 files failed")
+	assert.True(t, strings.HasPrefix(out, dat+": "))
+}
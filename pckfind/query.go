@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/azhai/gozzo-pck/find"
+)
+
+const QUERY_BATCH = 10000 // 从标准输入读取时，每批查找的Key个数
+
+// 输出一个Key和记录，format为tsv或json
+type printer struct {
+	writer *bufio.Writer
+	format string
+	keyEnc string
+}
+
+func newPrinter(w io.Writer, format, keyEnc string) (*printer, error) {
+	if format != "tsv" && format != "json" {
+		return nil, fmt.Errorf("Unknown output format %s, expect tsv or json", format)
+	}
+	if err := checkEncoding(keyEnc); err != nil {
+		return nil, err
+	}
+	return &printer{writer: bufio.NewWriter(w), format: format, keyEnc: keyEnc}, nil
+}
+
+// query不为空时是查找的Key，没有找到时key为nil
+func (p *printer) print(query string, key, record []byte) error {
+	if p.format == "tsv" {
+		var cols []string
+		if query != "" {
+			cols = append(cols, query)
+		}
+		if key != nil {
+			cols = append(cols, decodeKey(p.keyEnc, key), quoteText(string(record)))
+		}
+		_, err := p.writer.WriteString(strings.Join(cols, "\t") + "\n")
+		return err
+	}
+	obj := make(map[string]interface{})
+	if query != "" {
+		obj["query"] = query
+		obj["found"] = key != nil
+	}
+	if key != nil {
+		obj["key"] = decodeKey(p.keyEnc, key)
+		if utf8.Valid(record) { // 二进制的记录使用十六进制
+			obj["record"] = string(record)
+		} else {
+			obj["record_hex"] = hex.EncodeToString(record)
+		}
+	}
+	data, err := json.Marshal(obj)
+	if err == nil {
+		data = append(data, '\n')
+		_, err = p.writer.Write(data)
+	}
+	return err
+}
+
+func (p *printer) flush() error {
+	return p.writer.Flush()
+}
+
+// 查找参数中或标准输入中的Key，每行输出查找的Key、找到的Key和记录
+func runQuery(args []string) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	keyEnc := flags.String("key-encoding", "hex", "encoding of keys: "+strings.Join(keyEncodings, ", "))
+	format := flags.String("format", "tsv", "output format: tsv, json")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		return errUsage
+	}
+	p, err := newPrinter(os.Stdout, *format, *keyEnc)
+	if err != nil {
+		return err
+	}
+	f, err := find.OpenMmap(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var total, missed int
+	search := func(queries []string) error {
+		targets := make([][]byte, len(queries))
+		for i, query := range queries {
+			if targets[i], err = encodeKey(*keyEnc, query, f.Header.KeySize); err != nil {
+				return err
+			}
+		}
+		for i, entry := range f.SearchBatch(targets) {
+			var rec []byte
+			if entry.Addr != nil {
+				if rec, err = f.GetRecord(entry.Addr); err != nil {
+					return err
+				}
+			}
+			if rec == nil { // 没有找到，或者Key没有对应的记录
+				entry.Key = nil
+				missed++
+			}
+			if err = p.print(queries[i], entry.Key, rec); err != nil {
+				return err
+			}
+		}
+		total += len(queries)
+		return nil
+	}
+	if flags.NArg() > 1 {
+		err = search(flags.Args()[1:])
+	} else {
+		err = scanQueries(os.Stdin, search)
+	}
+	if e := p.flush(); err == nil {
+		err = e
+	}
+	if err == nil && missed > 0 {
+		err = fmt.Errorf("%d of %d keys not found", missed, total)
+	}
+	return err
+}
+
+// 分批读取标准输入中的Key，忽略空行
+func scanQueries(r io.Reader, search func(queries []string) error) error {
+	var queries []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if query := strings.TrimSpace(scanner.Text()); query != "" {
+			queries = append(queries, query)
+		}
+		if len(queries) >= QUERY_BATCH {
+			if err := search(queries); err != nil {
+				return err
+			}
+			queries = queries[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(queries) > 0 {
+		return search(queries)
+	}
+	return nil
+}
+
+// 按Key的顺序输出所有索引和记录，tsv格式可以再用build生成数据文件
+func runDump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	keyEnc := flags.String("key-encoding", "hex", "encoding of keys: "+strings.Join(keyEncodings, ", "))
+	format := flags.String("format", "tsv", "output format: tsv, json")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	p, err := newPrinter(os.Stdout, *format, *keyEnc)
+	if err != nil {
+		return err
+	}
+	f, err := find.OpenMmap(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = f.Walk(func(key, addr, record []byte) error {
+		if record == nil { // 没有记录的Key
+			return nil
+		}
+		return p.print("", key, record)
+	})
+	if e := p.flush(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// 显示头部、各部分的大小、Key和记录的个数，以及校验和
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	fp, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := find.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var (
+		keys, empty int
+		records     = make(map[uint64]bool)
+		recordBytes int
+	)
+	err = f.Walk(func(key, addr, record []byte) error {
+		keys++
+		if record == nil {
+			empty++
+		} else if pos := find.GetAddr(addr); !records[pos] {
+			records[pos] = true
+			recordBytes += len(record)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	h := f.Header
+	headerSize := uint64(h.GetHeaderSize())
+	recEnd, subSize := h.IdxBegin, uint64(0)
+	if h.BlockSize > 0 {
+		recEnd, subSize = h.SubBegin, h.IdxBegin-h.SubBegin
+	}
+	format := fmt.Sprintf("%d", h.Format)
+	if h.Legacy {
+		format = "legacy"
+	}
+	itemSize := fmt.Sprintf("%d", h.ItemSize)
+	if h.ItemSize == 0 {
+		itemSize = "variable"
+	}
+	rows := [][2]string{
+		{"file", flags.Arg(0)},
+		{"format", format},
+		{"version", h.Version},
+		{"key size", fmt.Sprintf("%d", h.KeySize)},
+		{"position size", fmt.Sprintf("%d", h.PositSize)},
+		{"item size", itemSize},
+		{"block size", fmt.Sprintf("%d", h.BlockSize)},
+		{"key count", fmt.Sprintf("%d", keys)},
+		{"keys without record", fmt.Sprintf("%d", empty)},
+		{"record count", fmt.Sprintf("%d", len(records))},
+		{"record text bytes", fmt.Sprintf("%d", recordBytes)},
+		{"file bytes", fmt.Sprintf("%d", info.Size())},
+		{"header bytes", fmt.Sprintf("%d", headerSize)},
+		{"record bytes", fmt.Sprintf("%d", recEnd-headerSize)},
+		{"subset bytes", fmt.Sprintf("%d", subSize)},
+		{"index bytes", fmt.Sprintf("%d", h.IdxEnd-h.IdxBegin)},
+		{"checksum", describeTrailer(fp, h)},
+	}
+	for _, row := range rows {
+		fmt.Printf("%-20s %s\n", row[0]+":", row[1])
+	}
+	return nil
+}
+
+func describeTrailer(r io.ReaderAt, header *find.DatHeader) string {
+	t, err := find.ReadTrailer(r, header)
+	if err == find.ErrNoChecksum {
+		return "none"
+	} else if err != nil {
+		return err.Error()
+	}
+	desc := fmt.Sprintf("unknown(%d)", t.Algo)
+	for name, algo := range checksumNames {
+		if int(t.Algo) == algo {
+			desc = name
+		}
+	}
+	if len(t.Signature) > 0 {
+		desc += ", signed"
+	}
+	return desc
+}
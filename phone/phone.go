@@ -37,7 +37,8 @@ func Mob2Bin(phone, ispName string) []byte {
 	code := Unknow
 	i := ChinaISP.ByRemark(ispName, false)
 	if i >= 0 {
-		code, _ = ChinaISP.Item(i)
+		value, _ := ChinaISP.Item(i)
+		code = ISP(value)
 	}
 	tail := string(code + '0')
 	return common.Hex2Bin(phone[:PHONE_SIZE] + tail)
@@ -108,7 +109,10 @@ func NewMobFinder(fdir string) *MobFinder {
 		builder.Build(fp, records, keypairs)
 	}
 	f := new(MobFinder)
-	f.Finder, _ = find.NewFinder(fp, MOB_KEY_SIZE, MOB_POS_SIZE)
+	if f.Finder, err = find.Open(fp); err != nil {
+		fmt.Println(err)
+		return nil
+	}
 	return f
 }
 
@@ -123,7 +127,7 @@ func (f *MobFinder) Find(phone string) (area, isp string, err error) {
 	if err == nil {
 		area = string(data)
 		x := key[len(key)-1] & 0x0f
-		_, isp = ChinaISP.Item(ChinaISP.ByValue(x))
+		_, isp = ChinaISP.Item(ChinaISP.ByValue(uint32(x)))
 	}
 	return
 }
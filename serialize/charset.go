@@ -0,0 +1,274 @@
+package serialize
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"unicode/utf8"
+)
+
+// 字符集
+type Charset int
+
+const (
+	CharsetUTF8    Charset = iota // 不转换
+	CharsetGBK                    // 单字节ASCII和双字节GBK
+	CharsetGB18030                // GBK加上四字节扩展
+)
+
+// 去除补位字节的规则
+const (
+	TrimNone  = 0
+	TrimNul   = 1 // 去除首尾的0x00
+	TrimSpace = 2 // 去除首尾的空格
+)
+
+const (
+	gbkTrailCount    = 0xfe - 0x40 + 1
+	gb18030FourMax   = 39419  // BMP部分最后一个线性序号
+	gb18030SuppBegin = 189000 // 0x90308130，即U+10000
+	gb18030SuppRunes = 0x10ffff - 0x10000
+	replacementGBK   = '?'
+	replacementRune  = utf8.RuneError
+)
+
+var (
+	gbkEncodeTable map[rune]uint16
+	gbkEncodeOnce  sync.Once
+)
+
+// 反向码表，首次使用时生成
+func getGBKEncodeTable() map[rune]uint16 {
+	gbkEncodeOnce.Do(func() {
+		gbkEncodeTable = make(map[rune]uint16, len(gbkDoubleTable))
+		for i, r := range gbkDoubleTable {
+			if r == 0 {
+				continue
+			}
+			lead, trail := i/gbkTrailCount+0x81, i%gbkTrailCount+0x40
+			if _, ok := gbkEncodeTable[rune(r)]; !ok {
+				gbkEncodeTable[rune(r)] = uint16(lead<<8 | trail)
+			}
+		}
+	})
+	return gbkEncodeTable
+}
+
+// 四字节编码的线性序号
+func fourLinear(b []byte) int {
+	return ((int(b[0]-0x81)*10+int(b[1]-0x30))*126+int(b[2]-0x81))*10 + int(b[3]-0x30)
+}
+
+func fourBytes(linear int) []byte {
+	b4 := byte(linear%10) + 0x30
+	linear /= 10
+	b3 := byte(linear%126) + 0x81
+	linear /= 126
+	b2 := byte(linear%10) + 0x30
+	b1 := byte(linear/10) + 0x81
+	return []byte{b1, b2, b3, b4}
+}
+
+func decodeFour(b []byte) rune {
+	if b[1] < 0x30 || b[1] > 0x39 || b[2] < 0x81 || b[2] > 0xfe || b[3] < 0x30 || b[3] > 0x39 {
+		return replacementRune
+	}
+	linear := fourLinear(b)
+	if linear >= gb18030SuppBegin {
+		if r := linear - gb18030SuppBegin; r <= gb18030SuppRunes {
+			return rune(r + 0x10000)
+		}
+		return replacementRune
+	}
+	if linear > gb18030FourMax {
+		return replacementRune
+	}
+	i := sort.Search(len(gb18030FourRanges), func(n int) bool {
+		return int(gb18030FourRanges[n][0]) > linear
+	}) - 1
+	start, code := gb18030FourRanges[i][0], gb18030FourRanges[i][1]
+	return rune(int(code) + linear - int(start))
+}
+
+func encodeFour(r rune) []byte {
+	if r >= 0x10000 {
+		return fourBytes(int(r-0x10000) + gb18030SuppBegin)
+	}
+	i := sort.Search(len(gb18030FourRanges), func(n int) bool {
+		return rune(gb18030FourRanges[n][1]) > r
+	}) - 1
+	if i < 0 {
+		return nil
+	}
+	start, code := gb18030FourRanges[i][0], gb18030FourRanges[i][1]
+	return fourBytes(int(start) + int(r) - int(code))
+}
+
+// GBK或GB18030编码转为UTF-8字符串
+func DecodeGBK(chunk []byte, cs Charset) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(chunk); {
+		b := chunk[i]
+		if b < 0x80 {
+			buf.WriteByte(b)
+			i++
+			continue
+		}
+		if b == 0x80 || b == 0xff || i+1 >= len(chunk) {
+			buf.WriteRune(replacementRune)
+			i++
+			continue
+		}
+		if next := chunk[i+1]; next >= 0x30 && next <= 0x39 {
+			if cs != CharsetGB18030 || i+3 >= len(chunk) {
+				buf.WriteRune(replacementRune)
+				i += 2
+				continue
+			}
+			buf.WriteRune(decodeFour(chunk[i : i+4]))
+			i += 4
+			continue
+		} else if next < 0x40 || next == 0x7f || next == 0xff {
+			buf.WriteRune(replacementRune)
+			i++
+			continue
+		}
+		idx := int(b-0x81)*gbkTrailCount + int(chunk[i+1]-0x40)
+		if r := gbkDoubleTable[idx]; r != 0 {
+			buf.WriteRune(rune(r))
+		} else {
+			buf.WriteRune(replacementRune)
+		}
+		i += 2
+	}
+	return buf.String()
+}
+
+// UTF-8字符串转为GBK或GB18030编码，无法编码的字符用?代替
+func EncodeGBK(text string, cs Charset) []byte {
+	table := getGBKEncodeTable()
+	buf := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r < 0x80 {
+			buf = append(buf, byte(r))
+		} else if code, ok := table[r]; ok {
+			buf = append(buf, byte(code>>8), byte(code))
+		} else if four := encodeFour(r); cs == CharsetGB18030 && four != nil && r != replacementRune {
+			buf = append(buf, four...)
+		} else {
+			buf = append(buf, replacementGBK)
+		}
+	}
+	return buf
+}
+
+// 编码后每个字符的开始位置，用于截断时不拆开多字节字符
+func charStarts(chunk []byte, cs Charset) []int {
+	var starts []int
+	for i := 0; i < len(chunk); {
+		starts = append(starts, i)
+		switch {
+		case cs == CharsetUTF8:
+			_, n := utf8.DecodeRune(chunk[i:])
+			i += n
+		case chunk[i] < 0x80:
+			i++
+		case cs == CharsetGB18030 && i+1 < len(chunk) && chunk[i+1] >= 0x30 && chunk[i+1] <= 0x39:
+			i += 4
+		default:
+			i += 2
+		}
+	}
+	return starts
+}
+
+// 对齐和补位，左对齐时在右边补位，右对齐时在左边补位，超长时截断尾部
+func PadBytes(data []byte, size int, pad byte, alignRight bool) []byte {
+	if size <= 0 || len(data) == size {
+		return data
+	}
+	if len(data) > size {
+		return data[:size]
+	}
+	padding := bytes.Repeat([]byte{pad}, size-len(data))
+	if alignRight {
+		return append(padding, data...)
+	}
+	return append(append([]byte{}, data...), padding...)
+}
+
+// 去除补位一侧的补位字节，以及首尾的NUL或空格
+func TrimBytes(data []byte, pad byte, alignRight bool, trim int) []byte {
+	if alignRight {
+		data = bytes.TrimLeft(data, string([]byte{pad}))
+	} else {
+		data = bytes.TrimRight(data, string([]byte{pad}))
+	}
+	var cutset []byte
+	if trim&TrimNul != 0 {
+		cutset = append(cutset, 0x00)
+	}
+	if trim&TrimSpace != 0 {
+		cutset = append(cutset, ' ')
+	}
+	if len(cutset) == 0 {
+		return data
+	}
+	return bytes.Trim(data, string(cutset))
+}
+
+// 指定字符集的文本，可以定长补位
+type Text struct {
+	Charset    Charset
+	Size       int  // 定长字节数，0为不定长
+	Pad        byte // 补位字节
+	AlignRight bool // 右对齐，即在左边补位
+	Trim       int  // 解码时去除首尾的补位字节和空白
+}
+
+func NewText(cs Charset, size int) *Text {
+	return &Text{Charset: cs, Size: size, Trim: TrimNul | TrimSpace}
+}
+
+func (s Text) EncodeString(text string) []byte {
+	var chunk []byte
+	if s.Charset == CharsetUTF8 {
+		chunk = []byte(text)
+	} else {
+		chunk = EncodeGBK(text, s.Charset)
+	}
+	if s.Size > 0 && len(chunk) > s.Size { // 截断时不拆开字符
+		starts := append(charStarts(chunk, s.Charset), len(chunk))
+		i := sort.SearchInts(starts, s.Size+1) - 1
+		chunk = chunk[:starts[i]]
+	}
+	return PadBytes(chunk, s.Size, s.Pad, s.AlignRight)
+}
+
+func (s Text) DecodeString(chunk []byte) string {
+	chunk = TrimBytes(chunk, s.Pad, s.AlignRight, s.Trim)
+	if s.Charset == CharsetUTF8 {
+		return string(chunk)
+	}
+	return DecodeGBK(chunk, s.Charset)
+}
+
+func (s Text) Pack(v interface{}) ([]byte, error) {
+	if text, ok := v.(string); ok {
+		return s.EncodeString(text), nil
+	}
+	return nil, typeError("string", v)
+}
+
+func (s Text) Unpack(chunk []byte) (interface{}, error) {
+	return s.DecodeString(chunk), nil
+}
+
+func (s Text) Encode(v interface{}) []byte {
+	chunk, _ := s.Pack(v)
+	return chunk
+}
+
+func (s Text) Decode(chunk []byte) interface{} {
+	return s.DecodeString(chunk)
+}
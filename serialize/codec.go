@@ -0,0 +1,150 @@
+package serialize
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/azhai/gozzo-pck/match"
+)
+
+// 编解码失败的字段，Path如body.items[3].speed
+type FieldError struct {
+	Path   string
+	Offset int
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s at offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// 在错误的路径前加上字段名，位置加上字段的开始位置
+func WrapFieldError(name string, offset int, err error) error {
+	switch e := err.(type) {
+	case *FieldError:
+		path := e.Path
+		if name != "" && !strings.HasPrefix(path, "[") {
+			path = "." + path
+		}
+		return &FieldError{Path: name + path, Offset: offset + e.Offset, Err: e.Err}
+	case *match.ShortError:
+		path := e.Name
+		if name != "" {
+			path = name + "." + path
+		}
+		return &FieldError{Path: path, Offset: offset + e.Offset, Err: io.ErrShortBuffer}
+	}
+	return &FieldError{Path: name, Offset: offset, Err: err}
+}
+
+// 类型不符
+type TypeError struct {
+	Want  string
+	Value interface{}
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("Expect %s, but got %T", e.Want, e.Value)
+}
+
+func typeError(want string, v interface{}) error {
+	return &TypeError{Want: want, Value: v}
+}
+
+// 出错时以错误作为解码结果，兼容IEncoder
+func valueOrError(v interface{}, err error) interface{} {
+	if err != nil {
+		return err
+	}
+	return v
+}
+
+// 旧的编码器，在解码结果为error或发生panic时返回错误
+type encoderCodec struct {
+	IEncoder
+}
+
+func (c encoderCodec) Pack(v interface{}) (chunk []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverError(r)
+		}
+	}()
+	return c.Encode(v), nil
+}
+
+func (c encoderCodec) Unpack(chunk []byte) (v interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverError(r)
+		}
+	}()
+	v = c.Decode(chunk)
+	if e, ok := v.(error); ok {
+		return nil, e
+	}
+	return v, nil
+}
+
+// panic的值为error时保留原来的错误
+func recoverError(r interface{}) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", r)
+}
+
+// 转为返回错误的编解码器
+func ToCodec(enc IEncoder) ICodec {
+	if c, ok := enc.(ICodec); ok {
+		return c
+	}
+	return encoderCodec{IEncoder: enc}
+}
+
+// 将解码结果赋给结构体成员，类型不符时尝试转换
+func SetValue(rf reflect.Value, val interface{}) error {
+	if val == nil {
+		rf.Set(reflect.Zero(rf.Type()))
+		return nil
+	}
+	rv := reflect.ValueOf(val)
+	rt := rf.Type()
+	if rv.Type().AssignableTo(rt) {
+		rf.Set(rv)
+		return nil
+	}
+	if rv.Kind() == reflect.Slice && rt.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Interface {
+		items := reflect.MakeSlice(rt, rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			if err := SetValue(items.Index(i), rv.Index(i).Interface()); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		rf.Set(items)
+		return nil
+	}
+	if isNumber(rv.Kind()) && isNumber(rt.Kind()) {
+		rf.Set(rv.Convert(rt))
+		return nil
+	}
+	if rt.Kind() == reflect.Ptr && rv.Kind() != reflect.Ptr { // 可选字段的成员为指针
+		elem := reflect.New(rt.Elem())
+		if err := SetValue(elem.Elem(), val); err != nil {
+			return err
+		}
+		rf.Set(elem)
+		return nil
+	}
+	return typeError(rt.String(), val)
+}
+
+func isNumber(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
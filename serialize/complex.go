@@ -1,7 +1,7 @@
 package serialize
 
 import (
-	"fmt"
+	"io"
 	"time"
 
 	"github.com/azhai/gozzo-utils/common"
@@ -51,25 +51,38 @@ func NewTwoDimXY(size int, x, y int64) *TwoDim {
 	return td
 }
 
-func (td TwoDim) Encode(v interface{}) []byte {
+func (td TwoDim) Pack(v interface{}) ([]byte, error) {
 	var dx, dy uint64
 	switch v := v.(type) {
 	case TwoDim:
 		dx, dy = v.Xdim, v.Ydim
 	case *TwoDim:
 		dx, dy = v.Xdim, v.Ydim
+	default:
+		return nil, typeError("TwoDim", v)
 	}
-	fmt.Printf("%d %d\n", dx, dy)
-	xbs := td.Unsigned.Encode(dx)
-	ybs := td.Unsigned.Encode(dy)
-	fmt.Printf("%x %x\n", xbs, ybs)
-	return append(xbs, ybs...)
+	xbs := td.Unsigned.EncodeUint64(dx)
+	ybs := td.Unsigned.EncodeUint64(dy)
+	return append(xbs, ybs...), nil
 }
 
-func (td *TwoDim) Decode(chunk []byte) interface{} {
+// 返回新的*TwoDim，象限和宽度与自身相同
+func (td TwoDim) Unpack(chunk []byte) (interface{}, error) {
+	if len(chunk) < td.Size*2 {
+		return nil, io.ErrShortBuffer
+	}
 	td.Xdim = td.Unsigned.DecodeUint64(chunk[:td.Size])
 	td.Ydim = td.Unsigned.DecodeUint64(chunk[td.Size:])
-	return td
+	return &td, nil
+}
+
+func (td TwoDim) Encode(v interface{}) []byte {
+	chunk, _ := td.Pack(v)
+	return chunk
+}
+
+func (td TwoDim) Decode(chunk []byte) interface{} {
+	return valueOrError(td.Unpack(chunk))
 }
 
 // 时间戳，精确到秒
@@ -85,16 +98,25 @@ func NewTimeStamp() *TimeStamp {
 	}
 }
 
-func (ts TimeStamp) Encode(v interface{}) []byte {
+func (ts TimeStamp) Pack(v interface{}) ([]byte, error) {
 	if t, ok := v.(time.Time); ok {
-		return ts.Integer.Encode(t.Unix())
+		return ts.Integer.Pack(t.Unix())
 	}
-	return nil
+	return nil, typeError("time.Time", v)
 }
 
-func (ts TimeStamp) Decode(chunk []byte) interface{} {
+func (ts TimeStamp) Unpack(chunk []byte) (interface{}, error) {
 	v := ts.Integer.DecodeInt64(chunk)
-	return time.Unix(v, 0)
+	return time.Unix(v, 0), nil
+}
+
+func (ts TimeStamp) Encode(v interface{}) []byte {
+	chunk, _ := ts.Pack(v)
+	return chunk
+}
+
+func (ts TimeStamp) Decode(chunk []byte) interface{} {
+	return valueOrError(ts.Unpack(chunk))
 }
 
 // 日期，格式20060102
@@ -102,18 +124,25 @@ type Date struct {
 	HexStr
 }
 
-func (d Date) Encode(v interface{}) []byte {
+func (d Date) Pack(v interface{}) ([]byte, error) {
 	if t, ok := v.(time.Time); ok {
-		return d.HexStr.Encode(t.Format(LayoutDate))
+		return d.HexStr.Pack(t.Format(LayoutDate))
 	}
-	return nil
+	return nil, typeError("time.Time", v)
 }
 
-func (d Date) Decode(chunk []byte) interface{} {
-	v := d.HexStr.Decode(chunk)
-	t, err := common.ParseDate(LayoutDate, v.(string))
-	if err == nil {
-		return t
+func (d Date) Unpack(chunk []byte) (interface{}, error) {
+	if err := CheckBCD(chunk); err != nil {
+		return nil, err
 	}
-	return nil
+	return common.ParseDate(LayoutDate, common.Bin2Hex(chunk))
+}
+
+func (d Date) Encode(v interface{}) []byte {
+	chunk, _ := d.Pack(v)
+	return chunk
+}
+
+func (d Date) Decode(chunk []byte) interface{} {
+	return valueOrError(d.Unpack(chunk))
 }
@@ -0,0 +1,59 @@
+package serialize
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/azhai/gozzo-utils/common"
+)
+
+// 字段的常量或允许的取值，比较的是原始字节
+type Constraint struct {
+	Values [][]byte
+	Const  bool // 常量，编码时总是使用Values[0]
+}
+
+func (c *Constraint) Allow(chunk []byte) bool {
+	for _, value := range c.Values {
+		if bytes.Equal(chunk, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// 有常量或取值范围的对象
+type IConstraint interface {
+	GetConstraint(name string) (*Constraint, bool)
+}
+
+// 常量或取值范围不符，如错误的帧头或文件标识
+type ConstError struct {
+	Got     []byte
+	Allowed [][]byte
+}
+
+func (e *ConstError) Error() string {
+	allowed := make([]string, len(e.Allowed))
+	for i, value := range e.Allowed {
+		allowed[i] = common.Bin2Hex(value)
+	}
+	tpl := "Unexpected value %x, expect %s"
+	return fmt.Sprintf(tpl, e.Got, strings.Join(allowed, " or "))
+}
+
+func getConstraint(s ISerializer, name string) (*Constraint, bool) {
+	if cs, ok := s.(IConstraint); ok {
+		return cs.GetConstraint(name)
+	}
+	return nil, false
+}
+
+// 检查解码前的原始字节
+func checkConstraint(s ISerializer, name string, chunk []byte) error {
+	if c, ok := getConstraint(s, name); ok && !c.Allow(chunk) {
+		return &ConstError{Got: chunk, Allowed: c.Values}
+	}
+	return nil
+}
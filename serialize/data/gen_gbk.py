@@ -0,0 +1,73 @@
+#!/usr/bin/env python3
+# 生成GBK/GB18030码表 ../charset_table.go
+# 用法：python3 gen_gbk.py > ../charset_table.go && gofmt -w ../charset_table.go
+
+LEAD_MIN, LEAD_MAX = 0x81, 0xFE
+TRAIL_MIN, TRAIL_MAX = 0x40, 0xFE
+TRAIL_COUNT = TRAIL_MAX - TRAIL_MIN + 1
+
+
+def double_table():
+    table = []
+    for lead in range(LEAD_MIN, LEAD_MAX + 1):
+        for trail in range(TRAIL_MIN, TRAIL_MAX + 1):
+            code = 0
+            if trail != 0x7F:
+                try:
+                    text = bytes([lead, trail]).decode("gb18030")
+                    if len(text) == 1 and ord(text) < 0x10000:
+                        code = ord(text)
+                except UnicodeDecodeError:
+                    pass
+            table.append(code)
+    return table
+
+
+def four_bytes(linear):
+    b4 = linear % 10 + 0x30
+    linear //= 10
+    b3 = linear % 126 + 0x81
+    linear //= 126
+    b2 = linear % 10 + 0x30
+    b1 = linear // 10 + 0x81
+    return bytes([b1, b2, b3, b4])
+
+
+def four_ranges():
+    ranges, last = [], None
+    for linear in range(0, 39420):
+        try:
+            text = four_bytes(linear).decode("gb18030")
+        except UnicodeDecodeError:
+            continue
+        code = ord(text)
+        if last is None or code != last[1] + (linear - last[0]):
+            ranges.append((linear, code))
+        last = ranges[-1]
+    return ranges
+
+
+def main():
+    print("// Code generated by data/gen_gbk.py; DO NOT EDIT.")
+    print()
+    print("package serialize")
+    print()
+    print("// GBK双字节码表，下标为(首字节-0x81)*191+(尾字节-0x40)，值为0表示未定义")
+    print("var gbkDoubleTable = [...]uint16{")
+    table = double_table()
+    for i in range(0, len(table), 12):
+        row = ", ".join("0x%04x" % c for c in table[i:i + 12])
+        print("\t%s," % row)
+    print("}")
+    print()
+    print("// GB18030四字节区BMP部分，每段为{线性序号, 起始码位}，段内连续递增")
+    print("var gb18030FourRanges = [...][2]uint16{")
+    ranges = four_ranges()
+    for i in range(0, len(ranges), 6):
+        row = ", ".join("{%d, 0x%04x}" % r for r in ranges[i:i + 6])
+        print("\t%s," % row)
+    print("}")
+
+
+if __name__ == "__main__":
+    main()
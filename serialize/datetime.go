@@ -0,0 +1,245 @@
+package serialize
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/azhai/gozzo-utils/common"
+)
+
+const (
+	// JT/T808等协议常用的BCD[6]时间格式
+	LayoutBCDTime = "060102150405"
+	// 时间精度
+	ResolutionSecond      = time.Second
+	ResolutionMillisecond = time.Millisecond
+)
+
+var (
+	// 常用的纪元起点
+	EpochUnix = time.Unix(0, 0).UTC()
+	Epoch2000 = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	// 东八区，即北京时间
+	LocationGMT8 = time.FixedZone("GMT+8", 8*3600)
+)
+
+// 错误的BCD码
+type BCDError struct {
+	Data  []byte
+	Index int // 出错字节的位置
+}
+
+func (e *BCDError) Error() string {
+	tpl := "Invalid BCD byte 0x%02x at %d in %x"
+	return fmt.Sprintf(tpl, e.Data[e.Index], e.Index, e.Data)
+}
+
+// 检查每个半字节都是0~9
+func CheckBCD(chunk []byte) error {
+	for i, b := range chunk {
+		if b>>4 > 9 || b&0x0f > 9 {
+			return &BCDError{Data: chunk, Index: i}
+		}
+	}
+	return nil
+}
+
+func getLocation(loc *time.Location) *time.Location {
+	if loc == nil {
+		return time.Local
+	}
+	return loc
+}
+
+// BCD码的日期时间，格式例如060102150405
+type BCDTime struct {
+	Layout   string
+	Location *time.Location
+}
+
+func NewBCDTime(layout string, loc *time.Location) *BCDTime {
+	if layout == "" {
+		layout = LayoutBCDTime
+	}
+	return &BCDTime{Layout: layout, Location: loc}
+}
+
+func (d BCDTime) Size() int {
+	return (len(d.Layout) + 1) / 2
+}
+
+func (d BCDTime) Pack(v interface{}) ([]byte, error) {
+	t, ok := v.(time.Time)
+	if !ok {
+		return nil, typeError("time.Time", v)
+	}
+	text := t.In(getLocation(d.Location)).Format(d.Layout)
+	if len(text)%2 == 1 { // 奇数位前面补0
+		text = "0" + text
+	}
+	return HexStr("").Pack(text)
+}
+
+func (d BCDTime) DecodeTime(chunk []byte) (time.Time, error) {
+	if len(chunk) < d.Size() {
+		tpl := "The length of BCD time is %d, little than %d"
+		return time.Time{}, fmt.Errorf(tpl, len(chunk), d.Size())
+	}
+	chunk = chunk[:d.Size()]
+	if err := CheckBCD(chunk); err != nil {
+		return time.Time{}, err
+	}
+	text := common.Bin2Hex(chunk)
+	if len(text) > len(d.Layout) { // 去掉补的0
+		text = text[len(text)-len(d.Layout):]
+	}
+	return time.ParseInLocation(d.Layout, text, getLocation(d.Location))
+}
+
+func (d BCDTime) Unpack(chunk []byte) (interface{}, error) {
+	return d.DecodeTime(chunk)
+}
+
+func (d BCDTime) Encode(v interface{}) []byte {
+	chunk, _ := d.Pack(v)
+	return chunk
+}
+
+func (d BCDTime) Decode(chunk []byte) interface{} {
+	return valueOrError(d.Unpack(chunk))
+}
+
+// 相对于纪元起点的计数，如Unix秒、毫秒或2000年起的秒数
+type EpochTime struct {
+	Epoch      time.Time
+	Resolution time.Duration
+	Location   *time.Location
+	*Unsigned
+}
+
+func NewEpochTime(size int, epoch time.Time, res time.Duration, loc *time.Location) *EpochTime {
+	if res <= 0 {
+		res = ResolutionSecond
+	}
+	return &EpochTime{
+		Epoch: epoch, Resolution: res, Location: loc,
+		Unsigned: NewUnsigned(size),
+	}
+}
+
+// 返回每秒的计数和每个计数的秒数，二者必有一个为1
+func (et EpochTime) units() (perSec, secs int64) {
+	res := int64(et.Resolution)
+	if res >= int64(time.Second) {
+		return 1, res / int64(time.Second)
+	}
+	return int64(time.Second) / res, 1
+}
+
+func (et EpochTime) Count(t time.Time) int64 {
+	perSec, secs := et.units()
+	delta := t.Unix() - et.Epoch.Unix()
+	nano := int64(t.Nanosecond() - et.Epoch.Nanosecond())
+	if perSec == 1 {
+		return delta / secs
+	}
+	return delta*perSec + nano/int64(et.Resolution)
+}
+
+func (et EpochTime) Time(n int64) time.Time {
+	perSec, secs := et.units()
+	sec, nano := et.Epoch.Unix(), int64(et.Epoch.Nanosecond())
+	if perSec == 1 {
+		sec += n * secs
+	} else {
+		sec += n / perSec
+		nano += n % perSec * int64(et.Resolution)
+	}
+	return time.Unix(sec, nano).In(getLocation(et.Location))
+}
+
+func (et EpochTime) Pack(v interface{}) ([]byte, error) {
+	if t, ok := v.(time.Time); ok {
+		return et.Unsigned.EncodeUint64(uint64(et.Count(t))), nil
+	}
+	return nil, typeError("time.Time", v)
+}
+
+func (et EpochTime) Unpack(chunk []byte) (interface{}, error) {
+	n := et.Unsigned.DecodeUint64(chunk)
+	return et.Time(int64(n)), nil
+}
+
+func (et EpochTime) Encode(v interface{}) []byte {
+	chunk, _ := et.Pack(v)
+	return chunk
+}
+
+func (et EpochTime) Decode(chunk []byte) interface{} {
+	return valueOrError(et.Unpack(chunk))
+}
+
+// DOS格式的日期时间，4字节，日期在高16位，秒数精确到2秒
+// 日期：7位年(1980起)、4位月、5位日，时间：5位时、6位分、5位秒/2
+type DosTime struct {
+	Location *time.Location
+	Order    binary.ByteOrder // 默认BigEndian，ZIP等文件中为LittleEndian
+}
+
+func NewDosTime(loc *time.Location) *DosTime {
+	return &DosTime{Location: loc, Order: binary.BigEndian}
+}
+
+func (d DosTime) byteOrder() binary.ByteOrder {
+	if d.Order == nil {
+		return binary.BigEndian
+	}
+	return d.Order
+}
+
+func (d DosTime) Pack(v interface{}) ([]byte, error) {
+	t, ok := v.(time.Time)
+	if !ok {
+		return nil, typeError("time.Time", v)
+	}
+	t = t.In(getLocation(d.Location))
+	year := t.Year() - 1980
+	if year < 0 {
+		year = 0
+	}
+	date := uint32(year)<<9 | uint32(t.Month())<<5 | uint32(t.Day())
+	clock := uint32(t.Hour())<<11 | uint32(t.Minute())<<5 | uint32(t.Second()/2)
+	chunk := make([]byte, 4)
+	d.byteOrder().PutUint32(chunk, date<<16|clock)
+	return chunk, nil
+}
+
+func (d DosTime) DecodeTime(chunk []byte) (time.Time, error) {
+	if len(chunk) < 4 {
+		tpl := "The length of DOS time is %d, little than 4"
+		return time.Time{}, fmt.Errorf(tpl, len(chunk))
+	}
+	v := d.byteOrder().Uint32(chunk)
+	date, clock := v>>16, v&0xffff
+	year, month, day := int(date>>9)+1980, int(date>>5&0x0f), int(date&0x1f)
+	hour, minute, sec := int(clock>>11), int(clock>>5&0x3f), int(clock&0x1f)*2
+	if month < 1 || month > 12 || day < 1 || hour > 23 || minute > 59 || sec > 59 {
+		return time.Time{}, fmt.Errorf("Invalid DOS time 0x%08x", v)
+	}
+	loc := getLocation(d.Location)
+	return time.Date(year, time.Month(month), day, hour, minute, sec, 0, loc), nil
+}
+
+func (d DosTime) Unpack(chunk []byte) (interface{}, error) {
+	return d.DecodeTime(chunk)
+}
+
+func (d DosTime) Encode(v interface{}) []byte {
+	chunk, _ := d.Pack(v)
+	return chunk
+}
+
+func (d DosTime) Decode(chunk []byte) interface{} {
+	return valueOrError(d.Unpack(chunk))
+}
@@ -1,14 +1,22 @@
 package serialize
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
 )
 
+// 解码时遇到未定义的值的处理方式
+const (
+	UnknownError   = iota // 解码失败
+	UnknownKeep           // 保留原始值，索引为-1
+	UnknownDefault        // 使用默认选项
+)
+
 // 枚举选项
 type Options struct {
-	values     []byte
+	values     []uint32
 	remarks    []string
 	isZeroBase bool // index和value的值相等（类型不同）
 }
@@ -16,7 +24,7 @@ type Options struct {
 func NewOptions(remarks []string) *Options {
 	opts := &Options{remarks: remarks, isZeroBase: true}
 	for i := 0; i < len(opts.remarks); i++ {
-		opts.values = append(opts.values, byte(i))
+		opts.values = append(opts.values, uint32(i))
 	}
 	return opts
 }
@@ -29,7 +37,7 @@ func NewMapOptions(options map[int]string) *Options {
 	sort.Ints(values)
 	opts := &Options{}
 	for _, val := range values {
-		opts.values = append(opts.values, byte(val))
+		opts.values = append(opts.values, uint32(val))
 		opts.remarks = append(opts.remarks, options[val])
 	}
 	return opts
@@ -39,22 +47,25 @@ func (t *Options) Size() int {
 	return len(t.values)
 }
 
-func (t *Options) Item(i int) (byte, string) {
+func (t *Options) Item(i int) (uint32, string) {
 	if i >= 0 && i < t.Size() {
 		return t.values[i], t.remarks[i]
 	}
-	return 0x00, ""
+	return 0, ""
 }
 
-func (t *Options) Search(v byte) int {
+func (t *Options) Search(v uint32) int {
 	return sort.Search(t.Size(), func(n int) bool {
 		return t.values[n] >= v
 	})
 }
 
-func (t *Options) ByValue(v byte) int {
+func (t *Options) ByValue(v uint32) int {
 	if t.isZeroBase {
-		return int(v)
+		if int64(v) < int64(t.Size()) {
+			return int(v)
+		}
+		return -1
 	}
 	if i := t.Search(v); i >= 0 && i < t.Size() {
 		if t.values[i] == v {
@@ -81,39 +92,155 @@ func (t *Options) ByRemark(r string, caseSensitive bool) int {
 	return -1
 }
 
-// 枚举类型
+// 枚举类型，线路上为1、2或4字节的值，通过ByValue对应到选项
 type Enum struct {
-	Opts *Options
-	Byte // opts的索引，范围0~255
+	Opts    *Options
+	Policy  int // 未定义值的处理方式
+	Default int // 默认选项的索引
+	index   int // opts的索引，未定义时为-1
+	value   uint32
+	*Unsigned
 }
 
 func NewEnum(opts *Options) *Enum {
-	return &Enum{Opts: opts, Byte: Byte(0)}
+	return NewEnumSize(opts, 1)
+}
+
+func NewEnumSize(opts *Options, size int) *Enum {
+	return &Enum{Opts: opts, Unsigned: NewUnsigned(size)}
 }
 
 func (m Enum) GetIndex() int {
-	return int(m.Byte)
+	return m.index
 }
 
-func (m Enum) GetItem() (byte, string) {
+func (m Enum) GetValue() uint32 {
+	return m.value
+}
+
+func (m Enum) GetItem() (uint32, string) {
 	return m.Opts.Item(m.GetIndex())
 }
 
 func (m Enum) ToString() string {
+	return m.String()
+}
+
+func (m Enum) String() string {
+	if m.index < 0 {
+		return fmt.Sprintf("Unknown(0x%x)", m.value)
+	}
 	_, mark := m.GetItem()
 	return mark
 }
 
 func (m *Enum) SetIndex(i int) error {
 	if i >= 0 && i < m.Opts.Size() {
-		m.Byte = Byte(i)
+		m.index = i
+		m.value, _ = m.Opts.Item(i)
 		return nil
 	}
 	return fmt.Errorf("Can not found the options of %d", i)
 }
 
-func (m *Enum) Decode(chunk []byte) interface{} {
-	b := m.Byte.Decode(chunk).(byte)
-	m.Byte = Byte(b)
-	return b
+// 根据线路上的值设置，未定义的值按Policy处理
+func (m *Enum) SetValue(v uint32) error {
+	if i := m.Opts.ByValue(v); i >= 0 {
+		m.index, m.value = i, v
+		return nil
+	}
+	switch m.Policy {
+	case UnknownKeep:
+		m.index, m.value = -1, v
+		return nil
+	case UnknownDefault:
+		return m.SetIndex(m.Default)
+	}
+	return fmt.Errorf("Can not found the options of value 0x%x", v)
+}
+
+func (m *Enum) SetRemark(r string) error {
+	if i := m.Opts.ByRemark(r, false); i >= 0 {
+		return m.SetIndex(i)
+	}
+	return fmt.Errorf("Can not found the options of %s", r)
+}
+
+// 与线路宽度对应的整数类型
+func (m Enum) typedValue() interface{} {
+	switch m.Cap() {
+	case 1:
+		return byte(m.value)
+	case 2:
+		return uint16(m.value)
+	default:
+		return m.value
+	}
+}
+
+func (m Enum) MarshalJSON() ([]byte, error) {
+	if m.index < 0 {
+		return json.Marshal(m.value)
+	}
+	return json.Marshal(m.String())
+}
+
+func (m *Enum) UnmarshalJSON(data []byte) error {
+	var remark string
+	if err := json.Unmarshal(data, &remark); err == nil {
+		return m.SetRemark(remark)
+	}
+	var value uint32
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return m.SetValue(value)
+}
+
+// 可以是选项的值、说明或另一个枚举
+func (m Enum) Pack(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case Enum:
+		return m.Unsigned.Pack(v.value)
+	case *Enum:
+		return m.Unsigned.Pack(v.value)
+	case string:
+		if i := m.Opts.ByRemark(v, false); i >= 0 {
+			value, _ := m.Opts.Item(i)
+			return m.Unsigned.Pack(value)
+		}
+		return nil, fmt.Errorf("Can not found the options of %s", v)
+	}
+	if n, ok := ToUint64(v); ok {
+		return m.Unsigned.Pack(uint32(n))
+	}
+	return nil, typeError("enum value", v)
+}
+
+// 根据线路上的值得到新的枚举，不修改自身
+func (m Enum) Parse(v interface{}) (Enum, error) {
+	n, ok := ToUint64(v)
+	if !ok {
+		return m, typeError("enum value", v)
+	}
+	err := m.SetValue(uint32(n))
+	return m, err
+}
+
+// 返回与宽度对应的整数，如byte，用Parse得到对应的选项
+func (m Enum) Unpack(chunk []byte) (interface{}, error) {
+	e, err := m.Parse(m.Unsigned.DecodeUint64(chunk))
+	if err != nil {
+		return nil, err
+	}
+	return e.typedValue(), nil
+}
+
+func (m Enum) Encode(v interface{}) []byte {
+	chunk, _ := m.Pack(v)
+	return chunk
+}
+
+func (m Enum) Decode(chunk []byte) interface{} {
+	return valueOrError(m.Unpack(chunk))
 }
@@ -0,0 +1,240 @@
+package serialize
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// 标志位的名称表，如JT/T808的状态位和报警位
+type FlagTable struct {
+	names map[uint]string
+	bits  map[string]uint
+	order []uint // 从低位到高位
+}
+
+func NewFlagTable(names map[uint]string) *FlagTable {
+	t := &FlagTable{
+		names: make(map[uint]string),
+		bits:  make(map[string]uint),
+	}
+	for bit, name := range names {
+		if bit < 64 && name != "" {
+			t.names[bit] = name
+			t.bits[name] = bit
+			t.order = append(t.order, bit)
+		}
+	}
+	sort.Slice(t.order, func(i, j int) bool {
+		return t.order[i] < t.order[j]
+	})
+	return t
+}
+
+// 名称表为nil时没有任何命名位，零值的FlagSet也可以使用
+func (t *FlagTable) Name(bit uint) string {
+	if t == nil {
+		return ""
+	}
+	return t.names[bit]
+}
+
+func (t *FlagTable) Bit(name string) (uint, bool) {
+	if t == nil {
+		return 0, false
+	}
+	bit, ok := t.bits[name]
+	return bit, ok
+}
+
+// 从低位到高位的命名位
+func (t *FlagTable) Bits() []uint {
+	if t == nil {
+		return nil
+	}
+	return t.order
+}
+
+// 按位的顺序列出名称
+func (t *FlagTable) Names() []string {
+	bits := t.Bits()
+	names := make([]string, len(bits))
+	for i, bit := range bits {
+		names[i] = t.names[bit]
+	}
+	return names
+}
+
+// 解码后的标志位集合，没有名称表时Names为空，Set返回错误
+type FlagSet struct {
+	Value uint64
+	Table *FlagTable
+}
+
+func (s FlagSet) IsSet(bit uint) bool {
+	return bit < 64 && s.Value&(1<<bit) != 0
+}
+
+func (s FlagSet) Has(name string) bool {
+	bit, ok := s.Table.Bit(name)
+	return ok && s.IsSet(bit)
+}
+
+func (s *FlagSet) Set(name string, on bool) error {
+	if s.Table == nil {
+		return fmt.Errorf("The flag set has no name table for %s", name)
+	}
+	bit, ok := s.Table.Bit(name)
+	if !ok {
+		return fmt.Errorf("Unknown flag %s", name)
+	}
+	if on {
+		s.Value |= 1 << bit
+	} else {
+		s.Value &^= 1 << bit
+	}
+	return nil
+}
+
+// 已置位的名称，未命名的位不列出
+func (s FlagSet) Names() []string {
+	names := make([]string, 0)
+	for _, bit := range s.Table.Bits() {
+		if s.IsSet(bit) {
+			names = append(names, s.Table.Name(bit))
+		}
+	}
+	return names
+}
+
+// 所有命名位的开关
+func (s FlagSet) Bools() map[string]bool {
+	result := make(map[string]bool)
+	for _, bit := range s.Table.Bits() {
+		result[s.Table.Name(bit)] = s.IsSet(bit)
+	}
+	return result
+}
+
+func (s FlagSet) String() string {
+	return strings.Join(s.Names(), "|")
+}
+
+// 结构体中bool成员对应的位，优先使用flag标签，否则为名称的首字母大写形式
+func (s FlagSet) structBits(rt reflect.Type) map[int]uint {
+	result := make(map[int]uint)
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.Type.Kind() != reflect.Bool {
+			continue
+		}
+		if tag := sf.Tag.Get("flag"); tag != "" {
+			if bit, ok := s.Table.Bit(tag); ok {
+				result[i] = bit
+			}
+			continue
+		}
+		for _, bit := range s.Table.Bits() {
+			if strings.Title(s.Table.Name(bit)) == sf.Name {
+				result[i] = bit
+			}
+		}
+	}
+	return result
+}
+
+// 填充结构体中的bool成员
+func (s FlagSet) ToStruct(dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("The destination must be a pointer of struct")
+	}
+	rv = rv.Elem()
+	for i, bit := range s.structBits(rv.Type()) {
+		rv.Field(i).SetBool(s.IsSet(bit))
+	}
+	return nil
+}
+
+// 从结构体中的bool成员读取
+func (s *FlagSet) FromStruct(src interface{}) {
+	rv := reflect.Indirect(reflect.ValueOf(src))
+	for i, bit := range s.structBits(rv.Type()) {
+		if rv.Field(i).Bool() {
+			s.Value |= 1 << bit
+		} else {
+			s.Value &^= 1 << bit
+		}
+	}
+}
+
+// 掩码标志位，宽度为1、2、4、8字节
+type Flags struct {
+	Table *FlagTable
+	*Unsigned
+}
+
+func NewFlags(size int, names map[uint]string) *Flags {
+	return &Flags{
+		Table:    NewFlagTable(names),
+		Unsigned: NewUnsigned(size),
+	}
+}
+
+func (f Flags) NewSet(value uint64) FlagSet {
+	return FlagSet{Value: value, Table: f.Table}
+}
+
+// 可以是FlagSet、整数、名称列表、名称到开关的映射，或含bool成员的结构体
+// 名称表中没有的名称返回错误
+func (f Flags) ToSet(v interface{}) (FlagSet, error) {
+	set := f.NewSet(0)
+	switch v := v.(type) {
+	case FlagSet:
+		set.Value = v.Value
+	case *FlagSet:
+		set.Value = v.Value
+	case []string:
+		for _, name := range v {
+			if err := set.Set(name, true); err != nil {
+				return set, err
+			}
+		}
+	case map[string]bool:
+		for name, on := range v {
+			if err := set.Set(name, on); err != nil {
+				return set, err
+			}
+		}
+	default:
+		if n, ok := ToUint64(v); ok {
+			set.Value = n
+		} else if rv := reflect.Indirect(reflect.ValueOf(v)); rv.Kind() == reflect.Struct {
+			set.FromStruct(rv.Interface())
+		} else {
+			return set, typeError("flags", v)
+		}
+	}
+	return set, nil
+}
+
+func (f Flags) Pack(v interface{}) ([]byte, error) {
+	set, err := f.ToSet(v)
+	if err != nil {
+		return nil, err
+	}
+	return f.Unsigned.EncodeUint64(set.Value), nil
+}
+
+func (f Flags) Unpack(chunk []byte) (interface{}, error) {
+	return f.NewSet(f.Unsigned.DecodeUint64(chunk)), nil
+}
+
+func (f Flags) Encode(v interface{}) []byte {
+	return packOrNil(f.Pack(v))
+}
+
+func (f Flags) Decode(chunk []byte) interface{} {
+	return valueOrError(f.Unpack(chunk))
+}
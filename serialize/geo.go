@@ -0,0 +1,194 @@
+package serialize
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	EarthRadius = 6371008.8 // 地球平均半径，单位米
+	ScaleMicro  = 1e6       // JT/T808的经纬度为百万分之一度
+)
+
+// 经纬度符号的存储方式
+const (
+	SignInteger = iota // 有符号整数（补码）
+	SignFlags          // 绝对值，前面一个字节的标志位，0位南纬，1位西经
+	SignNone           // 只有绝对值，符号在其他字段中，如JT/T808的状态位
+)
+
+// 地理坐标，单位为度，南纬和西经为负数
+type GeoPoint struct {
+	Lat float64
+	Lon float64
+}
+
+func NewGeoPoint(lat, lon float64) GeoPoint {
+	return GeoPoint{Lat: lat, Lon: lon}
+}
+
+func (p GeoPoint) IsValid() bool {
+	return math.Abs(p.Lat) <= 90 && math.Abs(p.Lon) <= 180
+}
+
+// 是否南纬、西经
+func (p GeoPoint) Hemisphere() (south, west bool) {
+	return p.Lat < 0, p.Lon < 0
+}
+
+// 用其他字段中的南纬、西经标志加上符号
+func (p GeoPoint) WithHemisphere(south, west bool) GeoPoint {
+	p.Lat, p.Lon = math.Abs(p.Lat), math.Abs(p.Lon)
+	if south {
+		p.Lat = -p.Lat
+	}
+	if west {
+		p.Lon = -p.Lon
+	}
+	return p
+}
+
+func (p GeoPoint) radians() (float64, float64) {
+	return p.Lat * math.Pi / 180, p.Lon * math.Pi / 180
+}
+
+// 两点之间的大圆距离，单位米
+func (p GeoPoint) Distance(q GeoPoint) float64 {
+	lat1, lon1 := p.radians()
+	lat2, lon2 := q.radians()
+	dlat, dlon := lat2-lat1, lon2-lon1
+	a := math.Pow(math.Sin(dlat/2), 2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dlon/2), 2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// 到另一点的初始方位角，正北为0，顺时针0~360度
+func (p GeoPoint) Bearing(q GeoPoint) float64 {
+	lat1, lon1 := p.radians()
+	lat2, lon2 := q.radians()
+	dlon := lon2 - lon1
+	y := math.Sin(dlon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dlon)
+	deg := math.Atan2(y, x) * 180 / math.Pi
+	return math.Mod(deg+360, 360)
+}
+
+// 是否在圆形区域内，半径单位米
+func (p GeoPoint) Within(center GeoPoint, radius float64) bool {
+	return p.Distance(center) <= radius
+}
+
+func (p GeoPoint) String() string {
+	return fmt.Sprintf("%.6f,%.6f", p.Lat, p.Lon)
+}
+
+// 解析String()的结果，如 29.951269,121.751595
+func ParseGeoPoint(text string) (GeoPoint, error) {
+	var p GeoPoint
+	_, err := fmt.Sscanf(text, "%g,%g", &p.Lat, &p.Lon)
+	if err == nil && !p.IsValid() {
+		err = fmt.Errorf("Invalid geo point %s", text)
+	}
+	return p, err
+}
+
+// 经纬度编码，按Scale转为整数，默认纬度在前
+type GeoCodec struct {
+	Scale    float64
+	Sign     int
+	LonFirst bool
+	*Unsigned
+}
+
+func NewGeoCodec(size int, scale float64, sign int) *GeoCodec {
+	return &GeoCodec{Scale: scale, Sign: sign, Unsigned: NewUnsigned(size)}
+}
+
+// 编码后的总长度
+func (g GeoCodec) Length() int {
+	if g.Sign == SignFlags {
+		return g.Size*2 + 1
+	}
+	return g.Size * 2
+}
+
+func (g GeoCodec) encodeDegree(deg float64) []byte {
+	n := int64(math.Round(deg * g.Scale))
+	if g.Sign != SignInteger && n < 0 {
+		n = -n
+	}
+	return g.Unsigned.EncodeUint64(uint64(n))
+}
+
+func (g GeoCodec) decodeDegree(chunk []byte) float64 {
+	n := g.Unsigned.DecodeUint64(chunk)
+	if g.Sign == SignInteger && g.Size < 8 { // 按宽度扩展符号位
+		shift := uint(64 - 8*g.Size)
+		return float64(int64(n<<shift)>>shift) / g.Scale
+	}
+	return float64(int64(n)) / g.Scale
+}
+
+func (g GeoCodec) Pack(v interface{}) ([]byte, error) {
+	var p GeoPoint
+	switch v := v.(type) {
+	case GeoPoint:
+		p = v
+	case *GeoPoint:
+		p = *v
+	default:
+		return nil, typeError("GeoPoint", v)
+	}
+	if !p.IsValid() {
+		return nil, fmt.Errorf("Invalid geo point %s", p)
+	}
+	var chunk []byte
+	if g.Sign == SignFlags {
+		flags := byte(0x00)
+		south, west := p.Hemisphere()
+		if south {
+			flags |= 0x01
+		}
+		if west {
+			flags |= 0x02
+		}
+		chunk = append(chunk, flags)
+	}
+	first, second := p.Lat, p.Lon
+	if g.LonFirst {
+		first, second = second, first
+	}
+	chunk = append(chunk, g.encodeDegree(first)...)
+	return append(chunk, g.encodeDegree(second)...), nil
+}
+
+func (g GeoCodec) Unpack(chunk []byte) (interface{}, error) {
+	if len(chunk) < g.Length() {
+		return nil, io.ErrShortBuffer
+	}
+	var flags byte
+	if g.Sign == SignFlags {
+		flags, chunk = chunk[0], chunk[1:]
+	}
+	p := GeoPoint{
+		Lat: g.decodeDegree(chunk[:g.Size]),
+		Lon: g.decodeDegree(chunk[g.Size : g.Size*2]),
+	}
+	if g.LonFirst {
+		p.Lat, p.Lon = p.Lon, p.Lat
+	}
+	if g.Sign == SignFlags {
+		p = p.WithHemisphere(flags&0x01 != 0, flags&0x02 != 0)
+	}
+	return p, nil
+}
+
+func (g GeoCodec) Encode(v interface{}) []byte {
+	chunk, _ := g.Pack(v)
+	return chunk
+}
+
+func (g GeoCodec) Decode(chunk []byte) interface{} {
+	return valueOrError(g.Unpack(chunk))
+}
@@ -0,0 +1,265 @@
+package serialize
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/azhai/gozzo-pck/match"
+)
+
+// 消息的值，可以是结构体成员，也可以是按字段名存放的Message
+type valueStore interface {
+	has(name string) bool // 能否存放这个字段
+	load(name string) (interface{}, bool)
+	store(name string, val interface{}) error
+	reset(name string)
+	variant() string
+	setVariant(name string)
+}
+
+// 结构体成员，字段名对应的成员名为首字母大写形式
+type structStore struct {
+	rv    reflect.Value
+	names map[string]string
+}
+
+func newStructStore(s ISerializer) *structStore {
+	names := s.GetNames()
+	if sel, ok := s.(ISelector); ok {
+		names = sel.GetAllNames()
+	}
+	return &structStore{rv: reflect.Indirect(reflect.ValueOf(s)), names: names}
+}
+
+func (st *structStore) member(name string) reflect.Value {
+	if member, ok := st.names[name]; ok {
+		return st.rv.FieldByName(member)
+	}
+	return reflect.Value{}
+}
+
+func (st *structStore) has(name string) bool {
+	rf := st.member(name)
+	return rf.IsValid() && rf.CanSet()
+}
+
+func (st *structStore) load(name string) (interface{}, bool) {
+	if rf := st.member(name); rf.IsValid() && rf.CanInterface() {
+		return rf.Interface(), true
+	}
+	return nil, false
+}
+
+func (st *structStore) store(name string, val interface{}) error {
+	if rf := st.member(name); rf.IsValid() && rf.CanSet() {
+		return SetValue(rf, val)
+	}
+	return nil
+}
+
+func (st *structStore) reset(name string) {
+	if rf := st.member(name); rf.IsValid() && rf.CanSet() {
+		rf.Set(reflect.Zero(rf.Type()))
+	}
+}
+
+// 共用布局时，版本记录在名为Variant的成员中
+func (st *structStore) variant() string {
+	if rf := st.rv.FieldByName("Variant"); rf.IsValid() && rf.Kind() == reflect.String {
+		return rf.String()
+	}
+	return ""
+}
+
+func (st *structStore) setVariant(name string) {
+	if rf := st.rv.FieldByName("Variant"); rf.IsValid() && rf.CanSet() && rf.Kind() == reflect.String {
+		rf.SetString(name)
+	}
+}
+
+// 一条消息的值，按字段名存放，不需要定义结构体
+type Message struct {
+	Variant string // 使用的版本，没有多个版本时为空
+	Values  map[string]interface{}
+}
+
+func NewMessage() *Message {
+	return &Message{Values: make(map[string]interface{})}
+}
+
+func (msg *Message) Get(name string) interface{} {
+	return msg.Values[name]
+}
+
+func (msg *Message) Set(name string, val interface{}) {
+	if msg.Values == nil {
+		msg.Values = make(map[string]interface{})
+	}
+	msg.Values[name] = val
+}
+
+func (msg *Message) has(name string) bool {
+	return true
+}
+
+func (msg *Message) load(name string) (interface{}, bool) {
+	val, ok := msg.Values[name]
+	return val, ok
+}
+
+func (msg *Message) store(name string, val interface{}) error {
+	msg.Set(name, val)
+	return nil
+}
+
+func (msg *Message) reset(name string) {
+	delete(msg.Values, name)
+}
+
+func (msg *Message) variant() string {
+	return msg.Variant
+}
+
+func (msg *Message) setVariant(name string) {
+	msg.Variant = name
+}
+
+// 编译后的布局，创建后不再修改，可以在多个goroutine中共用
+// 每条消息使用自己的结构体（内嵌*Layout）或Message
+type Layout struct {
+	matcher      *match.FieldMatcher
+	names        map[string]string
+	children     map[string]IEncoder
+	consts       map[string]*Constraint
+	refs         map[string]*SizeRef
+	variants     map[string]*Layout
+	defaultName  string
+	discriminate Discriminator
+}
+
+// 复制对象的布局，之后在原对象上增加字段、设置常量或长度字段不影响编译结果
+// 字段的编解码器（如Enum、Text、Flags和嵌套对象）不复制，与原对象共用，编译后不要再修改
+// 对象由Variants组成时，按数据识别版本，不再修改Variants
+func Compile(s ISerializer) *Layout {
+	vs, ok := s.(interface {
+		variantLayouts() (map[string]*Object, Discriminator, string)
+	})
+	if !ok {
+		return compileLayout(s)
+	}
+	layouts, discriminate, defaultName := vs.variantLayouts()
+	l := compileLayout(layouts[defaultName])
+	l.names = make(map[string]string)
+	l.variants = make(map[string]*Layout)
+	l.defaultName, l.discriminate = defaultName, discriminate
+	for name, obj := range layouts {
+		l.variants[name] = compileLayout(obj)
+		for field, member := range obj.GetNames() {
+			l.names[field] = member
+		}
+	}
+	return l
+}
+
+func compileLayout(s ISerializer) *Layout {
+	l := &Layout{
+		matcher:  s.GetMatcher().Clone(),
+		names:    make(map[string]string),
+		children: make(map[string]IEncoder),
+		consts:   make(map[string]*Constraint),
+		refs:     make(map[string]*SizeRef),
+	}
+	for name, member := range s.GetNames() {
+		l.names[name] = member
+	}
+	for _, name := range l.matcher.Names() {
+		if child, ok := s.GetChild(name); ok {
+			l.children[name] = child
+		}
+		if c, ok := getConstraint(s, name); ok {
+			cc := &Constraint{Const: c.Const}
+			for _, value := range c.Values {
+				cc.Values = append(cc.Values, append([]byte{}, value...))
+			}
+			l.consts[name] = cc
+		}
+		if r, ok := getSizeRef(s, name); ok {
+			rr := *r
+			l.refs[name] = &rr
+		}
+	}
+	return l
+}
+
+// 不要修改返回的FieldMatcher
+func (l *Layout) GetMatcher() *match.FieldMatcher {
+	return l.matcher
+}
+
+// 有多个版本时为所有版本的字段
+func (l *Layout) GetNames() map[string]string {
+	return l.names
+}
+
+func (l *Layout) GetChild(name string) (IEncoder, bool) {
+	child, ok := l.children[name]
+	return child, ok
+}
+
+func (l *Layout) GetConstraint(name string) (*Constraint, bool) {
+	c, ok := l.consts[name]
+	return c, ok
+}
+
+func (l *Layout) GetSizeRef(name string) (*SizeRef, bool) {
+	r, ok := l.refs[name]
+	return r, ok
+}
+
+// 所有版本的名称
+func (l *Layout) Variants() []string {
+	names := make([]string, 0, len(l.variants))
+	for name := range l.variants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (l *Layout) chooseVariant(chunk []byte) (string, error) {
+	if l.discriminate == nil {
+		return l.defaultName, nil
+	}
+	return l.discriminate(chunk)
+}
+
+// 版本为空时使用默认版本，没有多个版本时为自身
+func (l *Layout) variantLayout(name string) (ISerializer, bool) {
+	if l.variants == nil {
+		return l, true
+	}
+	if name == "" {
+		name = l.defaultName
+	}
+	v, ok := l.variants[name]
+	return v, ok
+}
+
+func (l *Layout) NewMessage() *Message {
+	msg := NewMessage()
+	msg.Variant = l.defaultName
+	return msg
+}
+
+// 解码为Message，版本记录在msg.Variant中
+func (l *Layout) Decode(chunk []byte) (*Message, error) {
+	msg := NewMessage()
+	if err := unpackValues(chunk, l, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (l *Layout) Encode(msg *Message) ([]byte, error) {
+	return packValues(l, msg)
+}
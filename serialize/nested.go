@@ -0,0 +1,152 @@
+package serialize
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/azhai/gozzo-pck/match"
+)
+
+// 嵌套的对象，解码时用Create创建新的实例
+type ObjectCodec struct {
+	Create func() ISerializer
+	proto  ISerializer // 用于计算长度
+}
+
+func NewObjectCodec(create func() ISerializer) *ObjectCodec {
+	return &ObjectCodec{Create: create, proto: create()}
+}
+
+// 对象在数据中占用的长度，有结尾段时为全部数据
+func (c ObjectCodec) Measure(data []byte) int {
+	return c.proto.GetMatcher().Measure(data)
+}
+
+func (c ObjectCodec) Pack(v interface{}) ([]byte, error) {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil, typeError("ISerializer", v)
+	}
+	if s, ok := v.(ISerializer); ok {
+		return Serialize(s)
+	}
+	return nil, typeError("ISerializer", v)
+}
+
+func (c ObjectCodec) Unpack(chunk []byte) (interface{}, error) {
+	s := c.Create()
+	if err := Unserialize(chunk, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c ObjectCodec) Encode(v interface{}) []byte {
+	chunk, _ := c.Pack(v)
+	return chunk
+}
+
+func (c ObjectCodec) Decode(chunk []byte) interface{} {
+	return valueOrError(c.Unpack(chunk))
+}
+
+// 列表，元素使用相同的编码，解码结果为[]interface{}
+type List struct {
+	Item     ICodec
+	ItemSize int               // 每个元素的长度，为0时使用Measure
+	Measure  match.MeasureFunc // 不定长元素的长度
+	Count    int               // 元素个数，为0时直到数据结束
+}
+
+func NewList(item IEncoder, itemSize, count int) *List {
+	l := &List{Item: ToCodec(item), ItemSize: itemSize, Count: count}
+	if m, ok := item.(interface{ Measure([]byte) int }); ok && itemSize <= 0 {
+		l.Measure = m.Measure
+	}
+	return l
+}
+
+// 下一个元素的长度，数据不完整时返回剩余长度，由元素自己报告错误
+func (l List) nextSize(data []byte) int {
+	size := l.ItemSize
+	if size <= 0 && l.Measure != nil {
+		size = l.Measure(data)
+	}
+	if size <= 0 || size > len(data) {
+		return len(data)
+	}
+	return size
+}
+
+// 列表在数据中占用的长度
+func (l List) MeasureList(data []byte) int {
+	if l.Count <= 0 {
+		return len(data)
+	}
+	if l.ItemSize > 0 {
+		return l.ItemSize * l.Count
+	}
+	offset := 0
+	for i := 0; i < l.Count; i++ {
+		if offset >= len(data) {
+			return -1
+		}
+		offset += l.nextSize(data[offset:])
+	}
+	return offset
+}
+
+func (l List) Pack(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, typeError("slice", v)
+	}
+	if l.Count > 0 && rv.Len() != l.Count {
+		err := fmt.Errorf("Expect %d items, but got %d", l.Count, rv.Len())
+		return nil, err
+	}
+	var chunk []byte
+	for i := 0; i < rv.Len(); i++ {
+		data, err := l.Item.Pack(rv.Index(i).Interface())
+		if err != nil {
+			return nil, WrapFieldError(fmt.Sprintf("[%d]", i), len(chunk), err)
+		}
+		if l.ItemSize > 0 {
+			data = PadBytes(data, l.ItemSize, 0x00, true)
+		}
+		chunk = append(chunk, data...)
+	}
+	return chunk, nil
+}
+
+func (l List) Unpack(chunk []byte) (interface{}, error) {
+	items := make([]interface{}, 0)
+	for offset, i := 0, 0; ; i++ {
+		if l.Count > 0 && i >= l.Count {
+			break
+		} else if l.Count <= 0 && offset >= len(chunk) {
+			break
+		}
+		path := fmt.Sprintf("[%d]", i)
+		if offset >= len(chunk) {
+			return nil, &FieldError{Path: path, Offset: offset, Err: io.ErrShortBuffer}
+		}
+		size := l.nextSize(chunk[offset:])
+		item, err := l.Item.Unpack(chunk[offset : offset+size])
+		if err != nil {
+			return nil, WrapFieldError(path, offset, err)
+		}
+		items = append(items, item)
+		offset += size
+	}
+	return items, nil
+}
+
+func (l List) Encode(v interface{}) []byte {
+	chunk, _ := l.Pack(v)
+	return chunk
+}
+
+func (l List) Decode(chunk []byte) interface{} {
+	return valueOrError(l.Unpack(chunk))
+}
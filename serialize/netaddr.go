@@ -0,0 +1,341 @@
+package serialize
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/azhai/gozzo-utils/common"
+)
+
+// IP地址，Size为4（IPv4）或16（IPv6）
+type IPAddr struct {
+	Size int
+}
+
+func NewIPAddr(size int) *IPAddr {
+	if size != net.IPv4len {
+		size = net.IPv6len
+	}
+	return &IPAddr{Size: size}
+}
+
+// 可以是net.IP或字符串，IPv4地址也可以存为16字节
+func (a IPAddr) Pack(v interface{}) ([]byte, error) {
+	var ip net.IP
+	switch v := v.(type) {
+	case net.IP:
+		ip = v
+	case string:
+		if ip = net.ParseIP(v); ip == nil {
+			return nil, fmt.Errorf("Invalid IP address %s", v)
+		}
+	default:
+		return nil, typeError("net.IP", v)
+	}
+	if a.Size == net.IPv4len {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("Can not store %s in %d bytes", v, a.Size)
+	}
+	return append([]byte{}, ip...), nil
+}
+
+func (a IPAddr) Unpack(chunk []byte) (interface{}, error) {
+	if len(chunk) < a.Size {
+		return nil, io.ErrShortBuffer
+	}
+	return net.IP(append([]byte{}, chunk[:a.Size]...)), nil
+}
+
+func (a IPAddr) Encode(v interface{}) []byte {
+	chunk, _ := a.Pack(v)
+	return chunk
+}
+
+func (a IPAddr) Decode(chunk []byte) interface{} {
+	return valueOrError(a.Unpack(chunk))
+}
+
+// MAC地址，6字节，EUI-64为8字节
+type MACAddr struct {
+	Size int
+}
+
+func NewMACAddr() *MACAddr {
+	return &MACAddr{Size: 6}
+}
+
+// 可以是net.HardwareAddr、字节数组或字符串，如 00:1a:2b:3c:4d:5e
+func (a MACAddr) Pack(v interface{}) ([]byte, error) {
+	var mac []byte
+	switch v := v.(type) {
+	case net.HardwareAddr:
+		mac = v
+	case []byte:
+		mac = v
+	case string:
+		addr, err := net.ParseMAC(v)
+		if err != nil {
+			return nil, err
+		}
+		mac = addr
+	default:
+		return nil, typeError("net.HardwareAddr", v)
+	}
+	if len(mac) != a.Size {
+		return nil, fmt.Errorf("Expect %d bytes MAC address, but got %d", a.Size, len(mac))
+	}
+	return append([]byte{}, mac...), nil
+}
+
+func (a MACAddr) Unpack(chunk []byte) (interface{}, error) {
+	if len(chunk) < a.Size {
+		return nil, io.ErrShortBuffer
+	}
+	return net.HardwareAddr(append([]byte{}, chunk[:a.Size]...)), nil
+}
+
+func (a MACAddr) Encode(v interface{}) []byte {
+	chunk, _ := a.Pack(v)
+	return chunk
+}
+
+func (a MACAddr) Decode(chunk []byte) interface{} {
+	return valueOrError(a.Unpack(chunk))
+}
+
+// 16字节的UUID
+type UUID [16]byte
+
+// 格式如 6ba7b810-9dad-11d1-80b4-00c04fd430c8，也可以没有连字符
+func ParseUUID(text string) (UUID, error) {
+	var u UUID
+	text = strings.Replace(strings.Trim(text, "{}"), "-", "", -1)
+	chunk, err := hex.DecodeString(text)
+	if err == nil && len(chunk) != len(u) {
+		err = fmt.Errorf("Invalid UUID %s", text)
+	}
+	copy(u[:], chunk)
+	return u, err
+}
+
+func (u UUID) String() string {
+	text := hex.EncodeToString(u[:])
+	return text[:8] + "-" + text[8:12] + "-" + text[12:16] + "-" + text[16:20] + "-" + text[20:]
+}
+
+func (u UUID) IsZero() bool {
+	return u == UUID{}
+}
+
+// UUID编码
+type UUIDCodec struct{}
+
+func (c UUIDCodec) Pack(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case UUID:
+		return append([]byte{}, v[:]...), nil
+	case *UUID:
+		return append([]byte{}, v[:]...), nil
+	case []byte:
+		if len(v) == len(UUID{}) {
+			return append([]byte{}, v...), nil
+		}
+	case string:
+		u, err := ParseUUID(v)
+		if err != nil {
+			return nil, err
+		}
+		return u[:], nil
+	}
+	return nil, typeError("UUID", v)
+}
+
+func (c UUIDCodec) Unpack(chunk []byte) (interface{}, error) {
+	var u UUID
+	if len(chunk) < len(u) {
+		return nil, io.ErrShortBuffer
+	}
+	copy(u[:], chunk)
+	return u, nil
+}
+
+func (c UUIDCodec) Encode(v interface{}) []byte {
+	chunk, _ := c.Pack(v)
+	return chunk
+}
+
+func (c UUIDCodec) Decode(chunk []byte) interface{} {
+	return valueOrError(c.Unpack(chunk))
+}
+
+// 超过8字节的无符号大整数，如128位的ID
+type BigUint struct {
+	Size int
+}
+
+func NewBigUint(size int) *BigUint {
+	return &BigUint{Size: size}
+}
+
+func toBigInt(v interface{}) (*big.Int, bool) {
+	switch v := v.(type) {
+	case *big.Int:
+		return v, v != nil
+	case big.Int:
+		return &v, true
+	case string:
+		return new(big.Int).SetString(v, 0)
+	case json.Number:
+		return new(big.Int).SetString(v.String(), 10)
+	}
+	if n, ok := ToUint64(v); ok {
+		return new(big.Int).SetUint64(n), true
+	}
+	return nil, false
+}
+
+// 可以是*big.Int、整数或十进制字符串（0x开头为十六进制）
+func (n BigUint) Pack(v interface{}) ([]byte, error) {
+	x, ok := toBigInt(v)
+	if !ok {
+		return nil, typeError("big.Int", v)
+	}
+	if x.Sign() < 0 || len(x.Bytes()) > n.Size {
+		return nil, fmt.Errorf("The number %s is overflow for %d bytes", x, n.Size)
+	}
+	return common.ResizeBytes(x.Bytes(), true, n.Size), nil
+}
+
+func (n BigUint) Unpack(chunk []byte) (interface{}, error) {
+	if len(chunk) < n.Size {
+		return nil, io.ErrShortBuffer
+	}
+	return new(big.Int).SetBytes(chunk[:n.Size]), nil
+}
+
+func (n BigUint) Encode(v interface{}) []byte {
+	chunk, _ := n.Pack(v)
+	return chunk
+}
+
+func (n BigUint) Decode(chunk []byte) interface{} {
+	return valueOrError(n.Unpack(chunk))
+}
+
+// Luhn校验，最后一位为校验位
+func LuhnValid(digits string) bool {
+	if len(digits) < 2 {
+		return false
+	}
+	check, err := LuhnDigit(digits[:len(digits)-1])
+	return err == nil && check == digits[len(digits)-1]
+}
+
+// 计算Luhn校验位
+func LuhnDigit(payload string) (byte, error) {
+	sum := 0
+	for i := len(payload) - 1; i >= 0; i-- {
+		c := payload[i]
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("Invalid digit %q in %s", c, payload)
+		}
+		d := int(c - '0')
+		if (len(payload)-i)%2 == 1 { // 从校验位左边开始，隔一位乘2
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10), nil
+}
+
+// BCD码的数字串，如IMEI、ICCID
+type BCDNumber struct {
+	Size      int
+	Digits    int  // 固定位数，为0时不限
+	PadRight  bool // 位数不足时在右边补F，否则在左边补0
+	CheckLuhn bool
+}
+
+// IMEI为15位，BCD[8]左边补0
+func NewIMEI() *BCDNumber {
+	return &BCDNumber{Size: 8, Digits: 15, CheckLuhn: true}
+}
+
+// ICCID为19或20位，BCD[10]右边补F
+func NewICCID() *BCDNumber {
+	return &BCDNumber{Size: 10, PadRight: true, CheckLuhn: true}
+}
+
+func (n BCDNumber) check(digits string) error {
+	if n.Digits > 0 && len(digits) != n.Digits {
+		return fmt.Errorf("Expect %d digits, but got %s", n.Digits, digits)
+	}
+	if len(digits) > n.Size*2 {
+		return fmt.Errorf("The number %s is too long for %d bytes", digits, n.Size)
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return fmt.Errorf("Invalid digit %q in %s", digits[i], digits)
+		}
+	}
+	if n.CheckLuhn && !LuhnValid(digits) {
+		return fmt.Errorf("Invalid check digit of %s", digits)
+	}
+	return nil
+}
+
+func (n BCDNumber) Pack(v interface{}) ([]byte, error) {
+	digits, ok := v.(string)
+	if !ok {
+		return nil, typeError("string", v)
+	}
+	if err := n.check(digits); err != nil {
+		return nil, err
+	}
+	if pad := n.Size*2 - len(digits); n.PadRight {
+		digits += strings.Repeat("f", pad)
+	} else {
+		digits = strings.Repeat("0", pad) + digits
+	}
+	return hex.DecodeString(digits)
+}
+
+func (n BCDNumber) Unpack(chunk []byte) (interface{}, error) {
+	if len(chunk) < n.Size {
+		return nil, io.ErrShortBuffer
+	}
+	digits := common.Bin2Hex(chunk[:n.Size])
+	if n.PadRight {
+		digits = strings.TrimRight(digits, "f")
+	} else if n.Digits > 0 && len(digits) > n.Digits {
+		pad := len(digits) - n.Digits
+		if strings.Trim(digits[:pad], "0") != "" {
+			return nil, &BCDError{Data: chunk, Index: 0}
+		}
+		digits = digits[pad:]
+	}
+	if err := n.check(digits); err != nil {
+		return nil, err
+	}
+	return digits, nil
+}
+
+func (n BCDNumber) Encode(v interface{}) []byte {
+	chunk, _ := n.Pack(v)
+	return chunk
+}
+
+func (n BCDNumber) Decode(chunk []byte) interface{} {
+	return valueOrError(n.Unpack(chunk))
+}
@@ -1,8 +1,10 @@
 package serialize
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/azhai/gozzo-pck/match"
 )
@@ -12,57 +14,225 @@ type IEncoder interface {
 	Decode(chunk []byte) interface{}
 }
 
+// 返回错误的编解码器，类型或数据不符时不会panic
+type ICodec interface {
+	Pack(v interface{}) ([]byte, error)
+	Unpack(chunk []byte) (interface{}, error)
+}
+
 type ISerializer interface {
 	GetMatcher() *match.FieldMatcher
 	GetNames() map[string]string
 	GetChild(name string) (IEncoder, bool)
 }
 
-func Serialize(s ISerializer) []byte {
-	data := make(map[string][]byte)
-	rv := reflect.Indirect(reflect.ValueOf(s))
-	for name, prop := range s.GetNames() {
-		child, ok := s.GetChild(name)
-		rf := rv.FieldByName(prop)
-		if ok && rf.IsValid() { // 存在的字段
-			data[name] = child.Encode(rf.Interface())
+// 按段的顺序编码，长度或个数字段在其他段编码之后计算，失败时返回字段路径和位置
+// 不兼容的变更：之前的版本只返回[]byte，见README中的“不兼容的变更”
+func Serialize(s ISerializer) ([]byte, error) {
+	return packValues(s, newStructStore(s))
+}
+
+// 按段的顺序解码，最后核对长度或个数字段，失败时返回字段路径和位置
+func Unserialize(chunk []byte, s ISerializer) error {
+	return unpackValues(chunk, s, newStructStore(s))
+}
+
+func packValues(s ISerializer, st valueStore) ([]byte, error) {
+	m, data, err := packFields(s, st)
+	if err != nil {
+		return nil, err
+	}
+	return m.Build(data), nil
+}
+
+// 长度或位置字段是变长时，最多重新计算的次数
+const sizeRefPasses = 8
+
+// 编码各段，组装由调用者完成
+func packFields(s ISerializer, st valueStore) (*match.FieldMatcher, map[string][]byte, error) {
+	l, err := encodeLayout(s, st)
+	if err != nil {
+		return nil, nil, WrapFieldError("", 0, err)
+	}
+	var (
+		m       = l.GetMatcher()
+		data    = make(map[string][]byte)
+		absent  = make(map[string]bool)
+		pending []string
+		offset  = 0
+	)
+	for _, name := range m.Names() {
+		child, ok := l.GetChild(name)
+		field := m.GetField(name)
+		if c, found := getConstraint(l, name); found && c.Const {
+			data[name] = c.Values[0]
+		} else if _, found = getSizeRef(l, name); found && ok {
+			pending = append(pending, name)
+		} else if ok {
+			val, found := st.load(name)
+			if field != nil && field.Optional {
+				if val, found = optionalValue(val, found); !found { // 不存在的可选字段
+					absent[name] = true
+					continue
+				}
+			}
+			if found {
+				chunk, err := ToCodec(child).Pack(val)
+				if err != nil {
+					return nil, nil, WrapFieldError(name, offset, err)
+				}
+				data[name] = chunk
+			}
 		}
+		offset += packedSize(field, data[name])
 	}
-	return s.GetMatcher().Build(data)
+	// 变长的长度或位置字段编码后，后面各段的位置会变化，重新计算直到位置不变
+	ranges := packedRanges(m, data, absent)
+	for pass := 1; len(pending) > 0; pass++ {
+		for _, name := range pending {
+			if err := packSizeRef(l, name, st, ranges, data); err != nil {
+				return nil, nil, WrapFieldError(name, ranges[name].Start, err)
+			}
+		}
+		next := packedRanges(m, data, absent)
+		if reflect.DeepEqual(next, ranges) {
+			break
+		} else if pass >= sizeRefPasses {
+			return nil, nil, WrapFieldError(pending[0], ranges[pending[0]].Start,
+				fmt.Errorf("The size fields do not converge"))
+		}
+		ranges = next
+	}
+	return m, data, nil
 }
 
-func Unserialize(chunk []byte, s ISerializer) error {
-	data, err := s.GetMatcher().Match(chunk, true)
+// 段编码后的长度，定长的段总是Size
+func packedSize(field *match.Field, chunk []byte) int {
+	if field != nil && field.Size > 0 && field.Measure == nil {
+		return field.Size
+	}
+	return len(chunk)
+}
+
+// 按编码后的长度计算各段的位置，不存在的可选段长度为0
+func packedRanges(m *match.FieldMatcher, data map[string][]byte, absent map[string]bool) map[string]match.Range {
+	ranges := make(map[string]match.Range)
+	offset := 0
+	for _, name := range m.Names() {
+		start := offset
+		if !absent[name] {
+			offset += packedSize(m.GetField(name), data[name])
+		}
+		ranges[name] = match.Range{Start: start, Stop: offset}
+	}
+	return ranges
+}
+
+// 可选字段的值，nil、空指针或nil切片表示不存在
+func optionalValue(val interface{}, found bool) (interface{}, bool) {
+	rv := reflect.ValueOf(val)
+	if !found || !rv.IsValid() {
+		return nil, false
+	}
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil, false
+		}
+		return rv.Elem().Interface(), true
+	case reflect.Slice, reflect.Map:
+		if rv.IsNil() {
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+// 计算长度或个数，同时回填到消息中
+func packSizeRef(s ISerializer, name string, st valueStore,
+	ranges map[string]match.Range, data map[string][]byte) error {
+	ref, _ := getSizeRef(s, name)
+	target, ok := ranges[ref.Target]
+	if !ok {
+		return fmt.Errorf("Can not found the field %s", ref.Target)
+	}
+	val, _ := st.load(ref.Target)
+	actual, ok := actualSize(ref, target, val)
+	if !ok {
+		return typeError("slice", val)
+	}
+	var old uint64
+	if val, found := st.load(name); found {
+		old, _ = ToUint64(val)
+	}
+	stored, err := ref.Store(actual, old, fieldLimit(s.GetMatcher().GetField(name)))
 	if err != nil {
 		return err
 	}
-	rv := reflect.Indirect(reflect.ValueOf(s))
-	var val interface{}
-	for name, prop := range s.GetNames() {
-		child, ok := s.GetChild(name)
-		rf := rv.FieldByName(prop)
-		if !ok || !rf.IsValid() || !rf.CanSet() {
+	child, _ := s.GetChild(name)
+	codec := ToCodec(child)
+	if data[name], err = codec.Pack(stored); err != nil {
+		return err
+	}
+	if val, err = codec.Unpack(data[name]); err == nil { // 按解码后的类型回填
+		err = st.store(name, val)
+	}
+	return err
+}
+
+func unpackValues(chunk []byte, s ISerializer, st valueStore) error {
+	l, err := decodeLayout(s, chunk, st)
+	if err != nil {
+		return WrapFieldError("", 0, err)
+	}
+	m := l.GetMatcher()
+	ranges, err := m.Ranges(chunk, true)
+	if err != nil {
+		return WrapFieldError("", 0, err)
+	}
+	values := make(map[string]interface{})
+	for _, name := range m.Names() {
+		var bin []byte
+		r, found := ranges[name]
+		if found {
+			bin = chunk[r.Start:r.Stop]
+		}
+		if field := m.GetField(name); !found && field != nil && field.Optional {
+			st.reset(name) // 数据中没有这个可选字段
+			continue
+		}
+		if err = checkConstraint(l, name, bin); err != nil {
+			return WrapFieldError(name, r.Start, err)
+		}
+		child, ok := l.GetChild(name)
+		if !ok || !st.has(name) {
 			continue
 		}
-		if bin, ok := data[name]; ok {
-			val = child.Decode(bin)
-		} else {
-			val = child.Decode(nil)
+		val, err := ToCodec(child).Unpack(bin)
+		if err == nil {
+			err = st.store(name, val)
+		}
+		if err != nil {
+			return WrapFieldError(name, r.Start, err)
 		}
-		rf.Set(reflect.ValueOf(val))
+		values[name] = val
 	}
-	return nil
+	return checkSizeRefs(l, chunk, ranges, values)
 }
 
 // 对象
 type Object struct {
 	children map[string]IEncoder
+	consts   map[string]*Constraint
+	refs     map[string]*SizeRef
 	Matcher  *match.FieldMatcher
 }
 
 func NewObject() *Object {
 	t := &Object{
 		children: make(map[string]IEncoder),
+		consts:   make(map[string]*Constraint),
+		refs:     make(map[string]*SizeRef),
 		Matcher:  match.NewFieldMatcher(),
 	}
 	t.children["rest"] = new(Bytes)
@@ -86,6 +256,77 @@ func (t *Object) GetChild(name string) (IEncoder, bool) {
 	return child, ok
 }
 
+func (t *Object) GetConstraint(name string) (*Constraint, bool) {
+	c, ok := t.consts[name]
+	return c, ok
+}
+
+// 用字段的编码器得到取值的原始字节
+func (t *Object) encodeValues(name string, values []interface{}) ([][]byte, error) {
+	child, ok := t.GetChild(name)
+	if !ok {
+		return nil, fmt.Errorf("Can not found the field %s", name)
+	}
+	result := make([][]byte, len(values))
+	for i, v := range values {
+		chunk, err := ToCodec(child).Pack(v)
+		if err != nil {
+			return nil, WrapFieldError(name, 0, err)
+		}
+		result[i] = chunk
+	}
+	return result, nil
+}
+
+// 设为常量，解码时检查，编码时总是输出这个值
+func (t *Object) SetConst(name string, value interface{}) error {
+	values, err := t.encodeValues(name, []interface{}{value})
+	if err == nil {
+		t.consts[name] = &Constraint{Values: values, Const: true}
+	}
+	return err
+}
+
+// 限定允许的取值，解码时检查
+func (t *Object) SetAllowed(name string, values ...interface{}) error {
+	chunks, err := t.encodeValues(name, values)
+	if err == nil {
+		t.consts[name] = &Constraint{Values: chunks}
+	}
+	return err
+}
+
+func (t *Object) GetSizeRef(name string) (*SizeRef, bool) {
+	r, ok := t.refs[name]
+	return r, ok
+}
+
+func (t *Object) setSizeRef(name, target, kind string) *SizeRef {
+	r := &SizeRef{Target: target, Kind: kind}
+	t.refs[name] = r
+	return r
+}
+
+// 记录目标段的字节数，可以再设置Mask和Adjust
+func (t *Object) SetLengthOf(name, target string) *SizeRef {
+	return t.setSizeRef(name, target, RefLength)
+}
+
+// 记录目标列表的元素个数，成员不是切片时需要设置Unit
+func (t *Object) SetCountOf(name, target string) *SizeRef {
+	return t.setSizeRef(name, target, RefCount)
+}
+
+// 记录目标段的开始位置
+func (t *Object) SetOffsetOf(name, target string) *SizeRef {
+	return t.setSizeRef(name, target, RefOffset)
+}
+
+// 记录目标段的结束位置
+func (t *Object) SetEndOf(name, target string) *SizeRef {
+	return t.setSizeRef(name, target, RefEnd)
+}
+
 func (t *Object) AddChild(name string, child IEncoder, field *match.Field) {
 	if name != "" {
 		t.children[name] = child
@@ -106,6 +347,13 @@ func (t *Object) AddSpanField(size int, rev bool) *match.Field {
 	return t.AddFixedChild("", nil, size, rev)
 }
 
+// 固定内容的字段，如文件标识，结构体中可以没有对应的成员
+func (t *Object) AddConstField(name string, value []byte, rev bool) *match.Field {
+	f := t.AddFixedChild(name, new(Bytes), len(value), rev)
+	t.consts[name] = &Constraint{Values: [][]byte{value}, Const: true}
+	return f
+}
+
 func (t *Object) AddByteField(name string, rev bool) *match.Field {
 	return t.AddFixedChild(name, new(Byte), 1, rev)
 }
@@ -114,10 +362,19 @@ func (t *Object) AddBytesField(name string, size int, rev bool) *match.Field {
 	return t.AddFixedChild(name, new(Bytes), size, rev)
 }
 
+// 定长字符串靠右，不足时在左边补0x00，超长时只保留结尾
+// 需要靠左（在右边补0x00，超长时截断结尾）时将AlignLeft改为true，或者使用AddTextField
 func (t *Object) AddStringField(name string, size int) *match.Field {
 	return t.AddFixedChild(name, new(String), size, false)
 }
 
+func (t *Object) AddTextField(name string, size int, cs Charset) (*match.Field, *Text) {
+	s := NewText(cs, size)
+	f := t.AddFixedChild(name, s, size, false)
+	f.AlignLeft = true
+	return f, s
+}
+
 func (t *Object) AddHexStrField(name string, size int) *match.Field {
 	return t.AddFixedChild(name, new(HexStr), size, false)
 }
@@ -127,8 +384,12 @@ func (t *Object) AddUintField(name string, size int) *match.Field {
 }
 
 func (t *Object) AddEnumField(name string, opts *Options) (*match.Field, *Enum) {
-	m := NewEnum(opts)
-	f := t.AddFixedChild(name, m, 1, false)
+	return t.AddEnumSizeField(name, 1, opts)
+}
+
+func (t *Object) AddEnumSizeField(name string, size int, opts *Options) (*match.Field, *Enum) {
+	m := NewEnumSize(opts, size)
+	f := t.AddFixedChild(name, m, m.Size, false)
 	return f, m
 }
 
@@ -138,6 +399,51 @@ func (t *Object) AddTwoDimField(name string, size int, x, y int64) (*match.Field
 	return f, td
 }
 
+// 经纬度，size为每个坐标的字节数
+func (t *Object) AddGeoField(name string, size int, scale float64, sign int) (*match.Field, *GeoCodec) {
+	g := NewGeoCodec(size, scale, sign)
+	f := t.AddFixedChild(name, g, g.Length(), false)
+	return f, g
+}
+
+func (t *Object) AddIPField(name string, size int) (*match.Field, *IPAddr) {
+	a := NewIPAddr(size)
+	f := t.AddFixedChild(name, a, a.Size, false)
+	return f, a
+}
+
+func (t *Object) AddPortField(name string) *match.Field {
+	return t.AddUintField(name, 2)
+}
+
+func (t *Object) AddMACField(name string) (*match.Field, *MACAddr) {
+	a := NewMACAddr()
+	f := t.AddFixedChild(name, a, a.Size, false)
+	return f, a
+}
+
+func (t *Object) AddUUIDField(name string) *match.Field {
+	return t.AddFixedChild(name, new(UUIDCodec), len(UUID{}), false)
+}
+
+func (t *Object) AddBigUintField(name string, size int) (*match.Field, *BigUint) {
+	n := NewBigUint(size)
+	f := t.AddFixedChild(name, n, size, false)
+	return f, n
+}
+
+func (t *Object) AddIMEIField(name string) (*match.Field, *BCDNumber) {
+	n := NewIMEI()
+	f := t.AddFixedChild(name, n, n.Size, false)
+	return f, n
+}
+
+func (t *Object) AddICCIDField(name string) (*match.Field, *BCDNumber) {
+	n := NewICCID()
+	f := t.AddFixedChild(name, n, n.Size, false)
+	return f, n
+}
+
 func (t *Object) AddTimeStampField(name string) (*match.Field, *TimeStamp) {
 	ts := NewTimeStamp()
 	f := t.AddFixedChild(name, ts, ts.Size, false)
@@ -149,3 +455,69 @@ func (t *Object) AddDateField(name string) (*match.Field, *Date) {
 	f := t.AddFixedChild(name, d, 4, false)
 	return f, d
 }
+
+func (t *Object) AddBCDTimeField(name, layout string, loc *time.Location) (*match.Field, *BCDTime) {
+	d := NewBCDTime(layout, loc)
+	f := t.AddFixedChild(name, d, d.Size(), false)
+	return f, d
+}
+
+func (t *Object) AddEpochTimeField(name string, size int, epoch time.Time,
+	res time.Duration, loc *time.Location) (*match.Field, *EpochTime) {
+	et := NewEpochTime(size, epoch, res, loc)
+	f := t.AddFixedChild(name, et, et.Size, false)
+	return f, et
+}
+
+func (t *Object) AddDosTimeField(name string, loc *time.Location) (*match.Field, *DosTime) {
+	d := NewDosTime(loc)
+	f := t.AddFixedChild(name, d, 4, false)
+	return f, d
+}
+
+func (t *Object) AddVarChild(name string, child IEncoder, measure match.MeasureFunc) *match.Field {
+	field := match.NewVarField(1, measure)
+	t.AddChild(name, child, field)
+	return field
+}
+
+func (t *Object) AddUvarintField(name string, maxSize int) (*match.Field, *Uvarint) {
+	n := NewUvarint(maxSize)
+	f := t.AddVarChild(name, n, n.Measure)
+	return f, n
+}
+
+func (t *Object) AddVarintField(name string, maxSize int) (*match.Field, *Varint) {
+	n := NewVarint(maxSize)
+	f := t.AddVarChild(name, n, n.Measure)
+	return f, n
+}
+
+func (t *Object) AddZigZagField(name string, maxSize int) (*match.Field, *ZigZag) {
+	n := NewZigZag(maxSize)
+	f := t.AddVarChild(name, n, n.Measure)
+	return f, n
+}
+
+func (t *Object) AddFlagsField(name string, size int, names map[uint]string) (*match.Field, *Flags) {
+	fs := NewFlags(size, names)
+	f := t.AddFixedChild(name, fs, fs.Size, false)
+	return f, fs
+}
+
+func (t *Object) AddObjectField(name string, create func() ISerializer) (*match.Field, *ObjectCodec) {
+	c := NewObjectCodec(create)
+	f := t.AddVarChild(name, c, c.Measure)
+	return f, c
+}
+
+// 元素个数count为0时，列表直到数据结尾
+func (t *Object) AddListField(name string, item IEncoder, itemSize, count int) (*match.Field, *List) {
+	l := NewList(item, itemSize, count)
+	if itemSize > 0 && count > 0 {
+		f := t.AddFixedChild(name, l, itemSize*count, false)
+		return f, l
+	}
+	f := t.AddVarChild(name, l, l.MeasureList)
+	return f, l
+}
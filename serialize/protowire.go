@@ -0,0 +1,167 @@
+package serialize
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// protobuf的字段类型
+const (
+	WireVarint     = 0
+	WireFixed64    = 1
+	WireBytes      = 2 // 字符串、字节数组或嵌套消息
+	WireStartGroup = 3 // 已废弃
+	WireEndGroup   = 4 // 已废弃
+	WireFixed32    = 5
+)
+
+const (
+	wireNumberMax = 1<<29 - 1
+	wireDepthMax  = 32 // 嵌套消息的最大深度
+)
+
+// 无schema解析出的protobuf字段
+type WireField struct {
+	Number   int
+	Type     int
+	Value    uint64       // varint、fixed32、fixed64的值
+	Bytes    []byte       // 变长字段的原始内容
+	Children []*WireField // 看起来像嵌套消息时，解析出的子字段
+}
+
+func (f WireField) IsMessage() bool {
+	return f.Type == WireBytes && f.Children != nil
+}
+
+func (f WireField) String() string {
+	switch {
+	case f.IsMessage():
+		return fmt.Sprintf("%d: %v", f.Number, f.Children)
+	case f.Type == WireBytes:
+		return fmt.Sprintf("%d: %q", f.Number, f.Bytes)
+	default:
+		return fmt.Sprintf("%d: %d", f.Number, f.Value)
+	}
+}
+
+// 看起来是否可读的文本，用于区分字符串和嵌套消息
+func isPrintable(chunk []byte) bool {
+	if !utf8.Valid(chunk) {
+		return false
+	}
+	for _, r := range string(chunk) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// 解析protobuf消息，变长字段能完整解析且不像文本时作为嵌套消息
+func DecodeWire(chunk []byte) ([]*WireField, error) {
+	return decodeWire(chunk, 0)
+}
+
+func decodeWire(chunk []byte, depth int) ([]*WireField, error) {
+	fields := make([]*WireField, 0)
+	for offset := 0; offset < len(chunk); {
+		key, n := binary.Uvarint(chunk[offset:])
+		if n <= 0 {
+			return nil, fmt.Errorf("Invalid wire key at offset %d", offset)
+		}
+		offset += n
+		f := &WireField{Number: int(key >> 3), Type: int(key & 0x07)}
+		if f.Number < 1 || f.Number > wireNumberMax {
+			return nil, fmt.Errorf("Invalid field number %d at offset %d", f.Number, offset-n)
+		}
+		rest := chunk[offset:]
+		switch f.Type {
+		case WireVarint:
+			if f.Value, n = binary.Uvarint(rest); n <= 0 {
+				return nil, fmt.Errorf("Invalid varint at offset %d", offset)
+			}
+		case WireFixed64:
+			if n = 8; len(rest) < n {
+				return nil, fmt.Errorf("Short fixed64 at offset %d", offset)
+			}
+			f.Value = binary.LittleEndian.Uint64(rest)
+		case WireFixed32:
+			if n = 4; len(rest) < n {
+				return nil, fmt.Errorf("Short fixed32 at offset %d", offset)
+			}
+			f.Value = uint64(binary.LittleEndian.Uint32(rest))
+		case WireBytes:
+			size, m := binary.Uvarint(rest)
+			if m <= 0 || size > uint64(len(rest)-m) {
+				return nil, fmt.Errorf("Invalid length at offset %d", offset)
+			}
+			n = m + int(size)
+			f.Bytes = rest[m:n]
+			if depth < wireDepthMax && len(f.Bytes) > 0 && !isPrintable(f.Bytes) {
+				if children, err := decodeWire(f.Bytes, depth+1); err == nil {
+					f.Children = children
+				}
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported wire type %d at offset %d", f.Type, offset-n)
+		}
+		offset += n
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// 将字段组装成protobuf消息，嵌套消息优先使用子字段
+func EncodeWire(fields []*WireField) []byte {
+	var chunk []byte
+	buf := make([]byte, MaxVarintLen)
+	putUvarint := func(x uint64) {
+		chunk = append(chunk, buf[:binary.PutUvarint(buf, x)]...)
+	}
+	for _, f := range fields {
+		putUvarint(uint64(f.Number)<<3 | uint64(f.Type))
+		switch f.Type {
+		case WireVarint:
+			putUvarint(f.Value)
+		case WireFixed64:
+			binary.LittleEndian.PutUint64(buf, f.Value)
+			chunk = append(chunk, buf[:8]...)
+		case WireFixed32:
+			binary.LittleEndian.PutUint32(buf, uint32(f.Value))
+			chunk = append(chunk, buf[:4]...)
+		case WireBytes:
+			data := f.Bytes
+			if f.Children != nil {
+				data = EncodeWire(f.Children)
+			}
+			putUvarint(uint64(len(data)))
+			chunk = append(chunk, data...)
+		}
+	}
+	return chunk
+}
+
+// protobuf消息，不需要schema
+type WireMessage struct{}
+
+func (s WireMessage) Pack(v interface{}) ([]byte, error) {
+	if fields, ok := v.([]*WireField); ok {
+		return EncodeWire(fields), nil
+	}
+	return nil, typeError("[]*WireField", v)
+}
+
+func (s WireMessage) Unpack(chunk []byte) (interface{}, error) {
+	return DecodeWire(chunk)
+}
+
+func (s WireMessage) Encode(v interface{}) []byte {
+	chunk, _ := s.Pack(v)
+	return chunk
+}
+
+func (s WireMessage) Decode(chunk []byte) interface{} {
+	return valueOrError(s.Unpack(chunk))
+}
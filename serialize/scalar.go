@@ -1,8 +1,8 @@
 package serialize
 
 import (
-	"bytes"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/azhai/gozzo-utils/common"
 )
@@ -10,23 +10,50 @@ import (
 // 单个字节
 type Byte byte
 
-func (n Byte) Encode(v interface{}) []byte {
-	return []byte{v.(byte)}
+func (n Byte) Pack(v interface{}) ([]byte, error) {
+	if b, ok := v.(byte); ok {
+		return []byte{b}, nil
+	}
+	if n, ok := ToUint64(v); ok && n <= 0xff {
+		return []byte{byte(n)}, nil
+	}
+	return nil, typeError("byte", v)
 }
 
-func (n Byte) Decode(chunk []byte) interface{} {
+func (n Byte) Unpack(chunk []byte) (interface{}, error) {
 	v := byte(0x00)
-	if chunk != nil {
+	if len(chunk) > 0 {
 		v = chunk[len(chunk)-1]
 	}
-	return v
+	return v, nil
+}
+
+func (n Byte) Encode(v interface{}) []byte {
+	chunk, _ := n.Pack(v)
+	return chunk
+}
+
+func (n Byte) Decode(chunk []byte) interface{} {
+	return valueOrError(n.Unpack(chunk))
 }
 
 // 字节数组
 type Bytes []byte
 
+func (s Bytes) Pack(v interface{}) ([]byte, error) {
+	if chunk, ok := v.([]byte); ok {
+		return chunk, nil
+	}
+	return nil, typeError("[]byte", v)
+}
+
+func (s Bytes) Unpack(chunk []byte) (interface{}, error) {
+	return chunk, nil
+}
+
 func (s Bytes) Encode(v interface{}) []byte {
-	return v.([]byte)
+	chunk, _ := s.Pack(v)
+	return chunk
 }
 
 func (s Bytes) Decode(chunk []byte) interface{} {
@@ -36,8 +63,20 @@ func (s Bytes) Decode(chunk []byte) interface{} {
 // 字符串
 type String string
 
+func (s String) Pack(v interface{}) ([]byte, error) {
+	if text, ok := v.(string); ok {
+		return []byte(text), nil
+	}
+	return nil, typeError("string", v)
+}
+
+func (s String) Unpack(chunk []byte) (interface{}, error) {
+	return string(chunk), nil
+}
+
 func (s String) Encode(v interface{}) []byte {
-	return []byte(v.(string))
+	chunk, _ := s.Pack(v)
+	return chunk
 }
 
 func (s String) Decode(chunk []byte) interface{} {
@@ -47,8 +86,25 @@ func (s String) Decode(chunk []byte) interface{} {
 // BCD码
 type HexStr string
 
+func (s HexStr) Pack(v interface{}) ([]byte, error) {
+	text, ok := v.(string)
+	if !ok {
+		return nil, typeError("string", v)
+	}
+	chunk := common.Hex2Bin(text)
+	if chunk == nil && text != "" {
+		return nil, fmt.Errorf("Invalid hex string %q", text)
+	}
+	return chunk, nil
+}
+
+func (s HexStr) Unpack(chunk []byte) (interface{}, error) {
+	return common.Bin2Hex(chunk), nil
+}
+
 func (s HexStr) Encode(v interface{}) []byte {
-	return common.Hex2Bin(v.(string))
+	chunk, _ := s.Pack(v)
+	return chunk
 }
 
 func (s HexStr) Decode(chunk []byte) interface{} {
@@ -86,36 +142,49 @@ func (n Unsigned) Cap() int {
 	}
 }
 
-func (n Unsigned) Encode(v interface{}) []byte {
-	buf := bytes.NewBuffer(nil)
-	_ = binary.Write(buf, binary.BigEndian, v)
+func (n Unsigned) EncodeUint64(v uint64) []byte {
 	chunk := make([]byte, n.MaxCap())
-	if size, _ := buf.Read(chunk); size > 0 {
-		chunk = chunk[:size]
-	}
+	binary.BigEndian.PutUint64(chunk, v)
 	return common.ResizeBytes(chunk, true, n.Size)
 }
 
+// 可以是各种整数，有符号数按补码
+func (n Unsigned) Pack(v interface{}) ([]byte, error) {
+	if x, ok := ToUint64(v); ok {
+		return n.EncodeUint64(x), nil
+	}
+	return nil, typeError("integer", v)
+}
+
 func (n Unsigned) DecodeUint64(chunk []byte) uint64 {
 	chunk = common.ResizeBytes(chunk, true, n.MaxCap())
 	return binary.BigEndian.Uint64(chunk)
 }
 
-func (n Unsigned) Decode(chunk []byte) interface{} {
+func (n Unsigned) Unpack(chunk []byte) (interface{}, error) {
 	capSize := n.Cap()
 	chunk = common.ResizeBytes(chunk, true, capSize)
 	switch capSize {
 	case 1:
-		return chunk[0]
+		return chunk[0], nil
 	case 2:
-		return binary.BigEndian.Uint16(chunk)
+		return binary.BigEndian.Uint16(chunk), nil
 	case 4:
-		return binary.BigEndian.Uint32(chunk)
+		return binary.BigEndian.Uint32(chunk), nil
 	default:
-		return binary.BigEndian.Uint64(chunk)
+		return binary.BigEndian.Uint64(chunk), nil
 	}
 }
 
+func (n Unsigned) Encode(v interface{}) []byte {
+	chunk, _ := n.Pack(v)
+	return chunk
+}
+
+func (n Unsigned) Decode(chunk []byte) interface{} {
+	return valueOrError(n.Unpack(chunk))
+}
+
 // 整数
 type Integer struct {
 	Negative bool
@@ -131,16 +200,20 @@ func (n Integer) DecodeInt64(chunk []byte) int64 {
 	}
 }
 
-func (n Integer) Decode(chunk []byte) interface{} {
+func (n Integer) Unpack(chunk []byte) (interface{}, error) {
 	v := n.DecodeInt64(chunk)
 	switch n.Cap() {
 	case 1:
-		return int8(v)
+		return int8(v), nil
 	case 2:
-		return int16(v)
+		return int16(v), nil
 	case 4:
-		return int32(v)
+		return int32(v), nil
 	default:
-		return v
+		return v, nil
 	}
 }
+
+func (n Integer) Decode(chunk []byte) interface{} {
+	return valueOrError(n.Unpack(chunk))
+}
@@ -2,11 +2,21 @@ package serialize
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/azhai/gozzo-utils/common"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 )
 
 var (
@@ -29,7 +39,7 @@ func Unescape(data []byte) []byte {
 	return bytes.Replace(data, []byte{0x7d, 0x01}, []byte{0x7d}, -1)
 }
 
-//异或校验
+// 异或校验
 func BlockCheck(block []byte) byte {
 	result := byte(0x00)
 	for _, bin := range block {
@@ -38,6 +48,23 @@ func BlockCheck(block []byte) byte {
 	return result
 }
 
+// 夹具中的约束出错时直接panic，字段名拼错时测试会失败，不会静默地忽略约束
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// 长度、个数等字段和它的目标都必须存在
+func mustRef(o *Object, name string) *SizeRef {
+	ref, ok := o.GetSizeRef(name)
+	m := o.GetMatcher()
+	if !ok || m.GetField(name) == nil || m.GetField(ref.Target) == nil {
+		panic(fmt.Sprintf("Invalid size ref %s", name))
+	}
+	return ref
+}
+
 // JT/T808协议外层
 type Proto808 struct {
 	Head   byte   // 消息头
@@ -66,6 +93,11 @@ func NewProto808() *Proto808 {
 	p.AddByteField("tail", true)
 	p.AddByteField("check", true)
 	// 剩余的会作为rest自动加上
+	must(p.SetConst("head", byte(0x7e)))
+	must(p.SetConst("tail", byte(0x7e)))
+	// 低10位为消息体长度
+	p.SetLengthOf("props", "rest").Mask = 0x03ff
+	mustRef(p.Object, "props")
 	return p
 }
 
@@ -85,7 +117,8 @@ func TestProto808(t *testing.T) {
 		assert.Len(t, p.Rest, int(p.Props))
 		assert.Equal(t, "082035085667", p.Mobile)
 		seq = p.Seqno - seq
-		t.Logf("%+v\n", p)
+		data, _ := ToJSON(p)
+		t.Log(string(data))
 
 		if len(p.Rest) == 5 {
 			_testBodyReply(t, p.Rest)
@@ -125,8 +158,12 @@ func _testBodyReply(t *testing.T, body []byte) {
 	assert.Equal(t, uint16(7), b.Seqno)
 	assert.Equal(t, "0200", b.Code)
 	assert.Equal(t, byte(0x03), b.Status)
-	assert.Equal(t, 3, b.StatusEnum.GetIndex())
-	assert.Equal(t, body, Serialize(b))
+	status, err := b.StatusEnum.Parse(b.Status)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, status.GetIndex())
+	chunk, err := Serialize(b)
+	assert.NoError(t, err)
+	assert.Equal(t, body, chunk)
 	t.Logf("%+v\n", b)
 }
 
@@ -155,13 +192,14 @@ func TestComplex(t *testing.T) {
 	c.Today = common.Today()
 	t.Logf("%+v\n", c)
 	// 序列化
-	body := Serialize(c)
+	body, err := Serialize(c)
+	assert.NoError(t, err)
 	t.Log(common.Bin2Hex(body))
 	// 清空
 	c.Point = NewTwoDimXY(4, -1, -2)
 	c.Now, c.Today = time.Unix(1, 0), time.Unix(2, 0)
 	// 解析
-	err := Unserialize(body, c)
+	err = Unserialize(body, c)
 	assert.NoError(t, err)
 	assert.Equal(t, QuadrantThird, c.Point.Quadrant)
 	assert.Equal(t, uint64(0-xdim), c.Point.Xdim)
@@ -170,3 +208,1212 @@ func TestComplex(t *testing.T) {
 	assert.Equal(t, common.ToDate(now).Unix(), c.Today.Unix())
 	t.Logf("%+v\n", c)
 }
+
+// 编码时不能有调试输出
+func TestTwoDimQuiet(t *testing.T) {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	td := NewTwoDimXY(4, -1, -2)
+	chunk, err := td.Pack(td)
+	os.Stdout = stdout
+	w.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "0000000100000002", common.Bin2Hex(chunk))
+	output, _ := io.ReadAll(r)
+	assert.Empty(t, output)
+}
+
+type BodyTime struct {
+	Clock  time.Time // BCD[6] YYMMDDhhmmss
+	Unix   time.Time // 4字节Unix秒
+	Milli  time.Time // 8字节Unix毫秒
+	Since  time.Time // 2000年起的秒数
+	Packed time.Time // DOS格式
+	*Object
+}
+
+func NewBodyTime() *BodyTime {
+	b := &BodyTime{Object: NewObject()}
+	b.AddBCDTimeField("clock", LayoutBCDTime, LocationGMT8)
+	b.AddEpochTimeField("unix", 4, EpochUnix, ResolutionSecond, nil)
+	b.AddEpochTimeField("milli", 8, EpochUnix, ResolutionMillisecond, nil)
+	b.AddEpochTimeField("since", 4, Epoch2000, ResolutionSecond, LocationGMT8)
+	b.AddDosTimeField("packed", nil)
+	return b
+}
+
+func TestDateTime(t *testing.T) {
+	now := time.Date(2019, 8, 28, 13, 45, 27, 789000000, time.Local)
+	b := NewBodyTime()
+	b.Clock, b.Unix, b.Milli, b.Since, b.Packed = now, now, now, now, now
+	body, err := Serialize(b)
+	assert.NoError(t, err)
+	t.Log(common.Bin2Hex(body))
+	assert.Len(t, body, 6+4+8+4+4)
+	assert.Equal(t, "190828", common.Bin2Hex(body[:3])[:6])
+	// 解析
+	c := NewBodyTime()
+	err = Unserialize(body, c)
+	assert.NoError(t, err)
+	assert.True(t, now.Truncate(time.Second).Equal(c.Clock))
+	assert.Equal(t, LocationGMT8, c.Clock.Location())
+	assert.Equal(t, now.Unix(), c.Unix.Unix())
+	assert.True(t, now.Truncate(time.Millisecond).Equal(c.Milli))
+	assert.Equal(t, now.Unix(), c.Since.Unix())
+	assert.Equal(t, now.Unix()-1, c.Packed.Unix()) // 精确到2秒
+	// 错误的BCD码
+	body[1] = 0x1a
+	err = Unserialize(body, c)
+	assert.Error(t, err)
+	t.Log(err)
+}
+
+type BodyDriver struct {
+	Plate  string // 车牌号，GBK编码
+	Name   string // 驾驶员姓名，右边补空格
+	Remark string // 备注，GB18030编码，左边补0x00
+	Cert   string // 证书编号，定长ASCII
+	*Object
+}
+
+func NewBodyDriver() *BodyDriver {
+	b := &BodyDriver{Object: NewObject()}
+	b.AddTextField("plate", 12, CharsetGBK)
+	_, name := b.AddTextField("name", 8, CharsetGBK)
+	name.Pad = ' '
+	_, remark := b.AddTextField("remark", 10, CharsetGB18030)
+	remark.AlignRight = true
+	b.AddStringField("cert", 6).AlignLeft = true
+	return b
+}
+
+func TestText(t *testing.T) {
+	b := NewBodyDriver()
+	b.Plate, b.Name, b.Remark, b.Cert = "粤B12345", "张三丰收到", "𠀀€", "A01"
+	body, err := Serialize(b)
+	assert.NoError(t, err)
+	t.Log(common.Bin2Hex(body))
+	assert.Len(t, body, 12+8+10+6)
+	assert.Equal(t, "d4c142313233343500000000", common.Bin2Hex(body[:12]))
+	assert.Equal(t, "d5c5c8fdb7e1cad5", common.Bin2Hex(body[12:20]))
+	assert.Equal(t, []byte("A01\x00\x00\x00"), body[30:])
+	// 解析
+	c := NewBodyDriver()
+	err = Unserialize(body, c)
+	assert.NoError(t, err)
+	assert.Equal(t, "粤B12345", c.Plate)
+	assert.Equal(t, "张三丰收", c.Name) // 超长截断，不拆开汉字
+	assert.Equal(t, b.Remark, c.Remark)
+	assert.Equal(t, "A01\x00\x00\x00", c.Cert)
+	// 无法编码的字符
+	assert.Equal(t, []byte("?"), EncodeGBK("𠀀", CharsetGBK))
+	assert.Equal(t, "�A", DecodeGBK([]byte{0x81, 0x30, 'A'}, CharsetGBK))
+}
+
+type BodyCert struct {
+	Cert  string
+	Seqno uint16
+	*Object
+}
+
+func NewBodyCert(alignLeft bool) *BodyCert {
+	b := &BodyCert{Object: NewObject()}
+	b.AddStringField("cert", 6).AlignLeft = alignLeft
+	b.AddUintField("seqno", 2)
+	return b
+}
+
+// 超长的定长字符串靠左时只保留开头，默认靠右时只保留结尾，后面的段位置不变
+func TestOversizedString(t *testing.T) {
+	cases := []struct {
+		alignLeft   bool
+		cert        string
+		body, short string
+	}{
+		{true, "ABCDEF", "ABCDEF\x01\x02", "A01\x00\x00\x00\x01\x02"},
+		{false, "CDEFGH", "CDEFGH\x01\x02", "\x00\x00\x00A01\x01\x02"},
+	}
+	for _, cs := range cases {
+		b := NewBodyCert(cs.alignLeft)
+		b.Cert, b.Seqno = "ABCDEFGH", 0x0102
+		body, err := Serialize(b)
+		assert.NoError(t, err)
+		assert.Equal(t, cs.body, string(body))
+		c := NewBodyCert(cs.alignLeft)
+		assert.NoError(t, Unserialize(body, c))
+		assert.Equal(t, cs.cert, c.Cert)
+		assert.Equal(t, uint16(0x0102), c.Seqno)
+		b.Cert = "A01"
+		body, err = Serialize(b)
+		assert.NoError(t, err)
+		assert.Equal(t, cs.short, string(body))
+	}
+}
+
+type BodyVarint struct {
+	Length uint64 // MQTT剩余长度
+	Delta  int64  // SLEB128
+	Offset int64  // ZigZag
+	Seqno  uint16
+	Rest   []byte
+	*Object
+}
+
+func NewBodyVarint() *BodyVarint {
+	b := &BodyVarint{Object: NewObject()}
+	b.AddUvarintField("length", MaxMqttLen)
+	b.AddVarintField("delta", 0)
+	b.AddZigZagField("offset", 0)
+	b.AddUintField("seqno", 2)
+	return b
+}
+
+func TestVarint(t *testing.T) {
+	b := NewBodyVarint()
+	b.Length, b.Delta, b.Offset, b.Seqno = 321, -129, -2, 7
+	b.Rest = []byte("payload")
+	body, err := Serialize(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "c102ff7e030007", common.Bin2Hex(body[:7]))
+	// 解析
+	c := NewBodyVarint()
+	err = Unserialize(body, c)
+	assert.NoError(t, err)
+	assert.Equal(t, b.Length, c.Length)
+	assert.Equal(t, b.Delta, c.Delta)
+	assert.Equal(t, b.Offset, c.Offset)
+	assert.Equal(t, b.Seqno, c.Seqno)
+	assert.Equal(t, b.Rest, c.Rest)
+	// MQTT剩余长度超过4字节
+	err = Unserialize(common.Hex2Bin("ffffffff7f0000000000"), c)
+	assert.Error(t, err)
+	t.Log(err)
+	b.Length = 1 << 28
+	_, err = Serialize(b)
+	assert.True(t, errors.Is(err, ErrVarint))
+	// 直接编码时不会panic，出错时为nil，错误从Pack取得
+	u := NewUvarint(MaxMqttLen)
+	assert.Nil(t, u.Encode(uint64(1<<28)))
+	assert.Nil(t, NewZigZag(1).Encode(int64(-65)))
+	assert.Nil(t, NewVarint(0).Encode("x"))
+	_, err = u.Pack(uint64(1 << 28))
+	assert.Equal(t, ErrVarint, err)
+	assert.Equal(t, []byte{0x7f}, u.Encode(127))
+}
+
+func TestProtoWire(t *testing.T) {
+	chunk := common.Hex2Bin("089601120774657374696e671a03089601")
+	fields, err := DecodeWire(chunk)
+	assert.NoError(t, err)
+	assert.Len(t, fields, 3)
+	assert.Equal(t, uint64(150), fields[0].Value)
+	assert.Equal(t, "testing", string(fields[1].Bytes))
+	assert.False(t, fields[1].IsMessage())
+	assert.True(t, fields[2].IsMessage())
+	assert.Equal(t, uint64(150), fields[2].Children[0].Value)
+	assert.Equal(t, chunk, EncodeWire(fields))
+	t.Log(fields)
+	_, err = DecodeWire([]byte{0x0a, 0x05, 0x01})
+	assert.Error(t, err)
+}
+
+var (
+	// JT/T808位置信息中的部分报警位和状态位
+	alarmNames  = map[uint]string{0: "emergency", 1: "overspeed", 2: "fatigue"}
+	statusNames = map[uint]string{0: "acc", 1: "located", 2: "south", 3: "west"}
+)
+
+type StatusBits struct {
+	Acc     bool
+	Located bool
+	South   bool
+	Western bool `flag:"west"`
+}
+
+type BodyFlags struct {
+	Alarm       FlagSet
+	AlarmFlags  *Flags
+	Status      FlagSet
+	StatusFlags *Flags
+	*Object
+}
+
+func NewBodyFlags() *BodyFlags {
+	b := &BodyFlags{Object: NewObject()}
+	_, b.AlarmFlags = b.AddFlagsField("alarm", 4, alarmNames)
+	_, b.StatusFlags = b.AddFlagsField("status", 4, statusNames)
+	return b
+}
+
+func TestFlags(t *testing.T) {
+	b := NewBodyFlags()
+	b.Alarm = b.AlarmFlags.NewSet(0)
+	assert.NoError(t, b.Alarm.Set("overspeed", true))
+	assert.Error(t, b.Alarm.Set("unknown", true))
+	_, err := b.AlarmFlags.ToSet([]string{"overspeed", "unknown"})
+	assert.EqualError(t, err, "Unknown flag unknown")
+	_, err = b.AlarmFlags.ToSet(map[string]bool{"unknown": false})
+	assert.Error(t, err)
+	_, err = b.AlarmFlags.ToSet("overspeed")
+	assert.Error(t, err)
+	b.Status, err = b.StatusFlags.ToSet(StatusBits{Acc: true, Located: true, Western: true})
+	assert.NoError(t, err)
+	body, err := Serialize(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "000000020000000b", common.Bin2Hex(body))
+	// 解析
+	c := NewBodyFlags()
+	err = Unserialize(body, c)
+	assert.NoError(t, err)
+	assert.True(t, c.Alarm.Has("overspeed"))
+	assert.Equal(t, []string{"acc", "located", "west"}, c.Status.Names())
+	assert.Equal(t, "acc|located|west", c.Status.String())
+	assert.False(t, c.Status.Bools()["south"])
+	var bits StatusBits
+	assert.NoError(t, c.Status.ToStruct(&bits))
+	assert.Equal(t, StatusBits{Acc: true, Located: true, Western: true}, bits)
+	// 从名称列表编码
+	chunk := b.StatusFlags.Encode([]string{"south", "acc"})
+	assert.Equal(t, "00000005", common.Bin2Hex(chunk))
+	assert.Nil(t, b.StatusFlags.Encode([]string{"north"}))
+	_, err = b.StatusFlags.Pack([]string{"south", "north"})
+	assert.EqualError(t, err, "Unknown flag north")
+	// 零值的FlagSet没有名称表，不会panic
+	var zero FlagSet
+	assert.False(t, zero.Has("acc"))
+	assert.Equal(t, "", zero.String())
+	assert.Len(t, zero.Bools(), 0)
+	assert.Error(t, zero.Set("acc", true))
+	assert.NoError(t, zero.ToStruct(&bits))
+	data, err := ToJSON(NewBodyFlags())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"alarm":[],"status":[]}`, string(data))
+	body, err = Serialize(NewBodyFlags())
+	assert.NoError(t, err)
+	assert.Equal(t, "0000000000000000", common.Bin2Hex(body))
+}
+
+// 稀疏的2字节代码
+var mediaOptions = NewMapOptions(map[int]string{0x0100: "JPEG", 0x0102: "TIF", 0x0200: "MP3", 0x0300: "WAV"})
+
+type BodyMedia struct {
+	Format     uint16
+	FormatEnum *Enum
+	*Object
+}
+
+func NewBodyMedia(policy int) *BodyMedia {
+	b := &BodyMedia{Object: NewObject()}
+	_, b.FormatEnum = b.AddEnumSizeField("format", 2, mediaOptions)
+	b.FormatEnum.Policy, b.FormatEnum.Default = policy, 0
+	return b
+}
+
+func TestEnum(t *testing.T) {
+	b := NewBodyMedia(UnknownError)
+	err := Unserialize([]byte{0x02, 0x00}, b)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0x0200), b.Format)
+	format, err := b.FormatEnum.Parse(b.Format)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, format.GetIndex())
+	assert.Equal(t, "MP3", format.String())
+	assert.Equal(t, "MP3", fmt.Sprint(format))
+	// 解码不修改编码器
+	assert.Equal(t, 0, b.FormatEnum.GetIndex())
+	data, err := json.Marshal(format)
+	assert.NoError(t, err)
+	assert.Equal(t, `"MP3"`, string(data))
+	assert.NoError(t, json.Unmarshal([]byte(`"tif"`), b.FormatEnum))
+	assert.Equal(t, uint32(0x0102), b.FormatEnum.GetValue())
+	assert.Equal(t, []byte{0x01, 0x02}, b.FormatEnum.Encode(b.FormatEnum))
+	// 未定义的值
+	err = Unserialize([]byte{0x02, 0x01}, b)
+	assert.Error(t, err)
+	t.Log(err)
+	b = NewBodyMedia(UnknownKeep)
+	assert.NoError(t, Unserialize([]byte{0x02, 0x01}, b))
+	assert.Equal(t, uint16(0x0201), b.Format)
+	format, _ = b.FormatEnum.Parse(b.Format)
+	assert.Equal(t, -1, format.GetIndex())
+	assert.Equal(t, "Unknown(0x201)", format.String())
+	data, _ = json.Marshal(format)
+	assert.Equal(t, "513", string(data))
+	b = NewBodyMedia(UnknownDefault)
+	assert.NoError(t, Unserialize([]byte{0x02, 0x01}, b))
+	assert.Equal(t, uint16(0x0100), b.Format)
+	format, _ = b.FormatEnum.Parse(b.Format)
+	assert.Equal(t, "JPEG", format.String())
+}
+
+// 多媒体或位置批量上传中的一项
+type BodyItem struct {
+	Flag  byte
+	Id    uint16
+	Speed uint16
+	Dir   uint16
+	*Object
+}
+
+func NewBodyItem() ISerializer {
+	b := &BodyItem{Object: NewObject()}
+	b.AddByteField("flag", false)
+	b.AddUintField("id", 2)
+	b.AddUintField("speed", 2)
+	b.AddUintField("dir", 2)
+	return b
+}
+
+type BodyBatch struct {
+	Seqno uint16
+	Items []*BodyItem
+	*Object
+}
+
+func NewBodyBatch() ISerializer {
+	b := &BodyBatch{Object: NewObject()}
+	b.AddUintField("seqno", 2)
+	b.AddListField("items", NewObjectCodec(NewBodyItem), 0, 0)
+	return b
+}
+
+type ProtoBatch struct {
+	Head byte
+	Body *BodyBatch
+	*Object
+}
+
+func NewProtoBatch() *ProtoBatch {
+	p := &ProtoBatch{Object: NewObject()}
+	p.AddByteField("head", false)
+	p.AddObjectField("body", NewBodyBatch)
+	return p
+}
+
+func TestFieldPath(t *testing.T) {
+	p := NewProtoBatch()
+	p.Head, p.Body = 0x7e, NewBodyBatch().(*BodyBatch)
+	for i := 0; i < 4; i++ {
+		item := NewBodyItem().(*BodyItem)
+		item.Flag, item.Id, item.Speed = 1, uint16(i), uint16(60+i)
+		p.Body.Items = append(p.Body.Items, item)
+	}
+	body, err := Serialize(p)
+	assert.NoError(t, err)
+	assert.Len(t, body, 1+2+7*4)
+	// 解析
+	q := NewProtoBatch()
+	err = Unserialize(body, q)
+	assert.NoError(t, err)
+	assert.Len(t, q.Body.Items, 4)
+	assert.Equal(t, uint16(63), q.Body.Items[3].Speed)
+	// 数据不完整
+	err = Unserialize(body[:27], q)
+	assert.EqualError(t, err, "body.items[3].speed at offset 27: short buffer")
+	var fe *FieldError
+	assert.True(t, errors.As(err, &fe))
+	assert.True(t, errors.Is(err, io.ErrShortBuffer))
+	// 类型不符时返回错误而不是panic
+	b := NewBodyReply()
+	b.Object.children["status"] = new(String)
+	_, err = Serialize(b)
+	assert.EqualError(t, err, "status at offset 4: Expect string, but got uint8")
+}
+
+func TestTree(t *testing.T) {
+	chunk := Unescape(common.Hex2Bin(data808))
+	p := NewProto808()
+	err := Unserialize(chunk, p)
+	assert.NoError(t, err)
+	// 导出为JSON，字段按顺序排列
+	data, err := ToJSON(p)
+	assert.NoError(t, err)
+	t.Log(string(data))
+	assert.True(t, strings.HasPrefix(string(data), `{"head":126,"code":"0200","props":91,"mobile":"082035085667","seqno":7,"rest":"`))
+	// 从JSON还原
+	q := NewProto808()
+	assert.NoError(t, FromJSON(data, q))
+	body, err := Serialize(q)
+	assert.NoError(t, err)
+	assert.Equal(t, chunk, body)
+	// 嵌套的对象和列表导出为YAML
+	b := NewProtoBatch()
+	body = common.Hex2Bin("7e0007" + "01000100410000" + "01000200420000")
+	tree, err := DecodeTree(body, b)
+	assert.NoError(t, err)
+	assert.Equal(t, NodeList, tree.Get("body").Get("items").Kind)
+	data, err = yaml.Marshal(tree)
+	assert.NoError(t, err)
+	t.Log(string(data))
+	assert.Contains(t, string(data), "body:\n  seqno: 7\n  items:\n  - flag: 1\n    id: 1\n    speed: 65\n")
+	assert.NoError(t, FromYAML(data, b))
+	chunk, err = Serialize(b)
+	assert.NoError(t, err)
+	assert.Equal(t, body, chunk)
+	// 超出成员类型范围的数字返回错误，不会被截断
+	for _, doc := range []string{"head: 300", "head: -1", "head: 1.5", "seqno: 65536"} {
+		err = FromYAML([]byte(doc), NewProto808())
+		assert.Error(t, err, doc)
+	}
+	assert.Error(t, FromJSON([]byte(`{"head":300}`), NewProto808()))
+	q = NewProto808()
+	assert.NoError(t, FromYAML([]byte("head: 255\nseqno: 65535"), q))
+	assert.Equal(t, byte(255), q.Head)
+	assert.Equal(t, uint16(65535), q.Seqno)
+}
+
+// 带文件标识的头部
+type FileHeader struct {
+	Version byte
+	Count   uint16
+	*Object
+}
+
+func NewFileHeader() *FileHeader {
+	h := &FileHeader{Object: NewObject()}
+	h.AddConstField("magic", []byte("PCK"), false)
+	h.AddByteField("version", false)
+	h.AddUintField("count", 2)
+	must(h.SetAllowed("version", byte(1), byte(2)))
+	return h
+}
+
+func TestConst(t *testing.T) {
+	// 夹具中拼错的字段名会失败
+	o := NewProto808().Object
+	assert.Panics(t, func() { must(o.SetConst("haed", byte(0x7e))) })
+	o.SetLengthOf("porps", "rest")
+	assert.Panics(t, func() { mustRef(o, "porps") })
+	o.SetLengthOf("props", "body")
+	assert.Panics(t, func() { mustRef(o, "props") })
+	// 编码时总是输出常量
+	p := NewProto808()
+	err := Unserialize(Unescape(common.Hex2Bin(reply808)), p)
+	assert.NoError(t, err)
+	p.Head, p.Tail = 0x00, 0x00
+	chunk, err := Serialize(p)
+	assert.NoError(t, err)
+	assert.Equal(t, reply808, common.Bin2Hex(chunk))
+	// 错误的帧尾
+	chunk[len(chunk)-1] = 0x7f
+	err = Unserialize(chunk, p)
+	var ce *ConstError
+	assert.True(t, errors.As(err, &ce))
+	assert.EqualError(t, err, "tail at offset 19: Unexpected value 7f, expect 7e")
+	// 文件标识和版本号
+	h := NewFileHeader()
+	h.Version, h.Count = 2, 9
+	chunk, err = Serialize(h)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("PCK\x02\x00\x09"), chunk)
+	assert.NoError(t, Unserialize(chunk, h))
+	chunk[3] = 0x03
+	assert.EqualError(t, Unserialize(chunk, h), "version at offset 3: Unexpected value 03, expect 01 or 02")
+	_, err = DecodeTree([]byte("ELF\x01\x00\x00"), h)
+	assert.True(t, errors.As(err, &ce))
+}
+
+// 带个数的列表
+type BodyCount struct {
+	Total byte
+	Items []*BodyItem
+	*Object
+}
+
+func NewBodyCount() *BodyCount {
+	b := &BodyCount{Object: NewObject()}
+	b.AddByteField("total", false)
+	b.AddListField("items", NewObjectCodec(NewBodyItem), 0, 0)
+	b.SetCountOf("total", "items")
+	mustRef(b.Object, "total")
+	return b
+}
+
+func TestSizeRef(t *testing.T) {
+	// 属性的高位保持不变
+	p := NewProto808()
+	p.Code, p.Mobile, p.Seqno = "8001", "082035085667", 1
+	p.Props, p.Rest = 0x2000|0x03ff, common.Hex2Bin("000702000a")
+	chunk, err := Serialize(p)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0x2005), p.Props)
+	assert.Equal(t, "2005", common.Bin2Hex(chunk[3:5]))
+	assert.NoError(t, Unserialize(chunk, p))
+	// 长度不符
+	chunk[4] = 0x06
+	err = Unserialize(chunk, p)
+	var se *SizeError
+	assert.True(t, errors.As(err, &se))
+	assert.EqualError(t, err, "props at offset 3: The length of rest is 5, but got 6")
+	// 超出掩码范围
+	p.Rest = make([]byte, 0x0400)
+	_, err = Serialize(p)
+	assert.EqualError(t, err, "props at offset 3: The length 1024 of rest is out of range")
+	// 元素个数
+	b := NewBodyCount()
+	for i := 0; i < 3; i++ {
+		item := NewBodyItem().(*BodyItem)
+		item.Id = uint16(i)
+		b.Items = append(b.Items, item)
+	}
+	chunk, err = Serialize(b)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(3), b.Total)
+	assert.Equal(t, byte(3), chunk[0])
+	c := NewBodyCount()
+	assert.NoError(t, Unserialize(chunk, c))
+	assert.Len(t, c.Items, 3)
+	chunk[0] = 0x02
+	assert.EqualError(t, Unserialize(chunk, c), "total at offset 0: The count of items is 3, but got 2")
+	_, err = DecodeTree(chunk, c)
+	assert.True(t, errors.As(err, &se))
+}
+
+// 变长的长度和位置字段在前面，编码后影响后面各段的位置
+type BodyOffset struct {
+	Size   uint64
+	Offset uint64
+	Pad    []byte
+	Text   []byte
+	*Object
+}
+
+func NewBodyOffset() *BodyOffset {
+	b := &BodyOffset{Object: NewObject()}
+	b.AddUvarintField("size", 0)
+	b.AddUvarintField("offset", 0)
+	b.AddBytesField("pad", 125, false)
+	b.AddBytesField("text", 0, false)
+	b.SetLengthOf("size", "text")
+	b.SetOffsetOf("offset", "text")
+	mustRef(b.Object, "size")
+	mustRef(b.Object, "offset")
+	return b
+}
+
+// 长度为200时size占2字节，text的位置因此超过127，offset也要再加1字节
+func TestVarintSizeRef(t *testing.T) {
+	for _, c := range []struct{ size, offset int }{{5, 127}, {200, 129}} {
+		b := NewBodyOffset()
+		b.Pad, b.Text = make([]byte, 125), bytes.Repeat([]byte("t"), c.size)
+		chunk, err := Serialize(b)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(c.size), b.Size)
+		assert.Equal(t, uint64(c.offset), b.Offset)
+		assert.Len(t, chunk, c.offset+c.size)
+		assert.Equal(t, b.Text, chunk[c.offset:])
+		d := NewBodyOffset()
+		assert.NoError(t, Unserialize(chunk, d))
+		assert.Equal(t, b.Offset, d.Offset)
+		assert.Equal(t, b.Text, d.Text)
+	}
+}
+
+// JT/T808协议外层，兼容2011、2013和2019版本
+type Proto808V struct {
+	Head    byte
+	Code    string
+	Props   uint16
+	Version byte // 协议版本号，2019版本才有
+	Mobile  string
+	Seqno   uint16
+	Rest    []byte
+	Check   byte
+	Tail    byte
+	*Variants
+}
+
+// 消息属性第14位为版本标识
+func detect808(chunk []byte) (string, error) {
+	if len(chunk) >= 5 && chunk[3]&0x40 != 0 {
+		return "2019", nil
+	}
+	return "2013", nil
+}
+
+func init808(o *Object, version bool, mobileSize int) {
+	o.AddByteField("head", false)
+	o.AddHexStrField("code", 2)
+	o.AddUintField("props", 2)
+	if version {
+		o.AddByteField("version", false)
+	}
+	o.AddHexStrField("mobile", mobileSize)
+	o.AddUintField("seqno", 2)
+	o.AddByteField("tail", true)
+	o.AddByteField("check", true)
+	must(o.SetConst("head", byte(0x7e)))
+	must(o.SetConst("tail", byte(0x7e)))
+	o.SetLengthOf("props", "rest").Mask = 0x03ff
+	mustRef(o, "props")
+}
+
+func NewProto808V() *Proto808V {
+	p := &Proto808V{Variants: NewVariants(detect808)}
+	init808(p.AddVariant("2013"), false, 6)
+	init808(p.AddVariant("2019"), true, 10)
+	return p
+}
+
+// 通用应答，较新的终端在结尾多了附加信息
+type BodyAck struct {
+	Seqno  uint16
+	Code   string
+	Status byte
+	Extra  *uint16
+	*Object
+}
+
+func NewBodyAck() *BodyAck {
+	b := &BodyAck{Object: NewObject()}
+	b.AddUintField("seqno", 2)
+	b.AddHexStrField("code", 2)
+	b.AddByteField("status", false)
+	b.AddUintField("extra", 2).Optional = true
+	return b
+}
+
+func TestVariants(t *testing.T) {
+	p := NewProto808V()
+	err := Unserialize(common.Hex2Bin(reply808), p)
+	assert.NoError(t, err)
+	assert.Equal(t, "2013", p.Variant)
+	assert.Equal(t, "082035085667", p.Mobile)
+	assert.Len(t, p.Rest, 5)
+	// 2019版本的消息
+	assert.NoError(t, p.SetVariant("2019"))
+	p.Props, p.Version, p.Mobile = 0x4000, 0x01, "00000000082035085667"
+	chunk, err := Serialize(p)
+	assert.NoError(t, err)
+	assert.Len(t, chunk, 1+2+2+1+10+2+5+2)
+	assert.Equal(t, uint16(0x4005), p.Props)
+	q := NewProto808V()
+	assert.NoError(t, Unserialize(chunk, q))
+	assert.Equal(t, "2019", q.Variant)
+	assert.Equal(t, byte(0x01), q.Version)
+	assert.Equal(t, p.Mobile, q.Mobile)
+	assert.Equal(t, p.Rest, q.Rest)
+	// 同一个实例再解码旧版本
+	assert.NoError(t, Unserialize(common.Hex2Bin(reply808), q))
+	assert.Equal(t, "2013", q.Variant)
+	assert.Equal(t, byte(0x00), q.Version)
+	assert.Equal(t, "082035085667", q.Mobile)
+	assert.Error(t, q.SetVariant("2021"))
+	// 直接修改为不存在的版本，返回错误而不是panic
+	q.Variant = "2021"
+	_, err = Serialize(q)
+	assert.Contains(t, err.Error(), "Unknown variant 2021")
+	q.Discriminate = nil
+	assert.Error(t, Unserialize(common.Hex2Bin(reply808), q))
+	_, err = NewObjectCodec(func() ISerializer { return NewProto808V() }).Pack(q)
+	assert.Error(t, err)
+
+	// 可选的结尾字段
+	b := NewBodyAck()
+	assert.NoError(t, Unserialize(common.Hex2Bin("0007020003"), b))
+	assert.Nil(t, b.Extra)
+	assert.Equal(t, byte(3), b.Status)
+	chunk, err = Serialize(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "0007020003", common.Bin2Hex(chunk))
+	assert.NoError(t, Unserialize(common.Hex2Bin("00070200030102"), b))
+	if assert.NotNil(t, b.Extra) {
+		assert.Equal(t, uint16(0x0102), *b.Extra)
+	}
+	chunk, err = Serialize(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "00070200030102", common.Bin2Hex(chunk))
+	assert.Error(t, Unserialize(common.Hex2Bin("000702"), b))
+}
+
+// 可选的签名，nil切片表示没有签名
+type BodySigned struct {
+	Seqno uint16
+	Sign  []byte
+	*Object
+}
+
+func NewBodySigned() *BodySigned {
+	b := &BodySigned{Object: NewObject()}
+	b.AddUintField("seqno", 2)
+	b.AddBytesField("sign", 4, false).Optional = true
+	return b
+}
+
+func TestOptionalSlice(t *testing.T) {
+	b := NewBodySigned()
+	b.Seqno = 7
+	chunk, err := Serialize(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "0007", common.Bin2Hex(chunk))
+	b.Sign = []byte{}
+	chunk, err = Serialize(b) // 空切片不是nil，存在
+	assert.NoError(t, err)
+	assert.Equal(t, "000700000000", common.Bin2Hex(chunk))
+	b.Sign = []byte{1, 2, 3, 4}
+	chunk, err = Serialize(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "000701020304", common.Bin2Hex(chunk))
+	c := NewBodySigned()
+	assert.NoError(t, Unserialize(chunk, c))
+	assert.Equal(t, b.Sign, c.Sign)
+	assert.NoError(t, Unserialize(common.Hex2Bin("0008"), c))
+	assert.Equal(t, uint16(8), c.Seqno)
+	assert.Nil(t, c.Sign)
+	// nil切片和nil映射都表示不存在，空切片表示存在
+	for _, val := range []interface{}{[]byte(nil), map[string]int(nil), nil} {
+		_, found := optionalValue(val, true)
+		assert.False(t, found)
+	}
+	val, found := optionalValue([]byte{}, true)
+	assert.True(t, found)
+	assert.Equal(t, []byte{}, val)
+	_, found = optionalValue([]byte{1}, false)
+	assert.False(t, found)
+}
+
+// 共用布局的通用应答，每条消息一个实例
+type ReplyMessage struct {
+	Seqno  uint16
+	Code   string
+	Status byte
+	*Layout
+}
+
+var (
+	layoutReply = Compile(NewBodyReply())
+	layout808   = Compile(NewProto808V())
+)
+
+func TestLayout(t *testing.T) {
+	body := common.Hex2Bin("0007020003")
+	r := &ReplyMessage{Layout: layoutReply}
+	assert.NoError(t, Unserialize(body, r))
+	assert.Equal(t, byte(0x03), r.Status)
+	chunk, err := Serialize(r)
+	assert.NoError(t, err)
+	assert.Equal(t, body, chunk)
+	// 编译后对原对象的修改不影响布局
+	b := NewBodyReply()
+	l := Compile(b)
+	b.AddByteField("extra", false)
+	assert.Len(t, l.GetMatcher().Sequence, 3)
+	assert.Len(t, b.GetMatcher().Sequence, 4)
+	status, _ := l.GetChild("status") // 编解码器是共用的
+	assert.True(t, status == IEncoder(b.StatusEnum))
+	// 常量和长度字段也是复制的，原地修改也不影响
+	p := NewProto808()
+	pl := Compile(p)
+	tail, _ := p.GetConstraint("tail")
+	tail.Values[0][0] = 0x00
+	props, _ := p.GetSizeRef("props")
+	props.Mask = 0xffff
+	must(p.SetConst("head", byte(0x7f)))
+	for _, name := range []string{"head", "tail"} {
+		c, _ := pl.GetConstraint(name)
+		assert.Equal(t, [][]byte{{0x7e}}, c.Values, name)
+	}
+	ref, _ := pl.GetSizeRef("props")
+	assert.Equal(t, uint64(0x03ff), ref.Mask)
+	msg, err := pl.Decode(Unescape(common.Hex2Bin(reply808)))
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0x7e), msg.Get("head"))
+	assert.Error(t, Unserialize(Unescape(common.Hex2Bin(reply808)), p))
+	// 按字段名存放的消息
+	chunk = common.Hex2Bin(reply808)
+	msg, err = layout808.Decode(chunk)
+	assert.NoError(t, err)
+	assert.Equal(t, "2013", msg.Variant)
+	assert.Equal(t, "082035085667", msg.Get("mobile"))
+	assert.Equal(t, uint16(5), msg.Get("props"))
+	msg.Variant = "2019"
+	msg.Set("props", uint16(0x4000))
+	msg.Set("version", byte(0x01))
+	msg.Set("mobile", "00000000082035085667")
+	chunk, err = layout808.Encode(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0x4005), msg.Get("props"))
+	msg, err = layout808.Decode(chunk)
+	assert.NoError(t, err)
+	assert.Equal(t, "2019", msg.Variant)
+	assert.Equal(t, byte(0x01), msg.Get("version"))
+	assert.Equal(t, []string{"2013", "2019"}, layout808.Variants())
+	msg.Variant = "2021"
+	_, err = layout808.Encode(msg)
+	assert.Error(t, err)
+}
+
+// 用 go test -race 检查
+func TestLayoutRace(t *testing.T) {
+	msg := layout808.NewMessage()
+	msg.Variant = "2019"
+	msg.Values = map[string]interface{}{
+		"code": "8001", "props": uint16(0x4000), "version": byte(0x01),
+		"mobile": "00000000082035085667", "seqno": uint16(9),
+		"rest": common.Hex2Bin("0007020003"), "check": byte(0x00),
+	}
+	chunk2019, err := layout808.Encode(msg)
+	assert.NoError(t, err)
+	frames := [][]byte{common.Hex2Bin(reply808), chunk2019}
+	body := common.Hex2Bin("0007020003")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				frame := frames[(i+j)%2]
+				msg, err := layout808.Decode(frame)
+				if !assert.NoError(t, err) {
+					return
+				}
+				chunk, err := layout808.Encode(msg)
+				assert.NoError(t, err)
+				assert.Equal(t, frame, chunk)
+				r := &ReplyMessage{Layout: layoutReply}
+				assert.NoError(t, Unserialize(msg.Get("rest").([]byte), r))
+				chunk, err = Serialize(r)
+				assert.NoError(t, err)
+				assert.Equal(t, body, chunk)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestView(t *testing.T) {
+	chunk := Unescape(common.Hex2Bin(data808))
+	v, err := NewView(chunk, layout808)
+	assert.NoError(t, err)
+	assert.Equal(t, "2013", v.Variant)
+	code, err := v.GetString("code")
+	assert.NoError(t, err)
+	assert.Equal(t, "0200", code)
+	mobile, err := v.Get("mobile")
+	assert.NoError(t, err)
+	assert.Equal(t, "082035085667", mobile)
+	rest, err := v.Raw("rest")
+	assert.NoError(t, err)
+	props, _ := v.Get("props")
+	assert.Len(t, rest, int(props.(uint16)))
+	assert.False(t, v.Has("version"))
+	_, err = v.Get("version")
+	assert.Error(t, err)
+	// 只取命令ID时不分配内存
+	allocs := testing.AllocsPerRun(100, func() {
+		v.Raw("code")
+	})
+	assert.Equal(t, float64(0), allocs)
+	// 只检查访问到的字段
+	bad := append([]byte{}, chunk...)
+	bad[len(bad)-1] = 0x00
+	v, err = NewView(bad, layout808)
+	assert.NoError(t, err)
+	_, err = v.Get("seqno")
+	assert.NoError(t, err)
+	_, err = v.Get("tail")
+	var ce *ConstError
+	assert.True(t, errors.As(err, &ce))
+	// 可选字段
+	v, _ = NewView(common.Hex2Bin("0007020003"), Compile(NewBodyAck()))
+	extra, err := v.Get("extra")
+	assert.NoError(t, err)
+	assert.Nil(t, extra)
+	assert.False(t, v.Has("extra"))
+	// 数据不完整
+	v, _ = NewView(common.Hex2Bin("7e8001"), layout808)
+	_, err = v.Raw("code")
+	assert.True(t, errors.Is(err, io.ErrShortBuffer))
+}
+
+func TestStream(t *testing.T) {
+	var buf bytes.Buffer
+	frames := [][]byte{Unescape(common.Hex2Bin(data808)), common.Hex2Bin(reply808)}
+	for _, frame := range frames {
+		buf.Write(frame)
+	}
+	// 按消息属性中的长度读取，不多读
+	p := NewProto808()
+	r := bytes.NewReader(buf.Bytes())
+	for i, frame := range frames {
+		n, err := UnserializeFrom(r, p)
+		assert.NoError(t, err)
+		assert.Equal(t, len(frame), n, "frame %d", i)
+		assert.Len(t, p.Rest, int(p.Props&0x03ff))
+	}
+	assert.Equal(t, "8001", p.Code)
+	_, err := UnserializeFrom(r, p)
+	assert.Equal(t, io.EOF, err)
+	// 数据不完整
+	_, err = UnserializeFrom(bytes.NewReader(frames[1][:10]), p)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	_, err = UnserializeFrom(bytes.NewReader(frames[1][:15]), p)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	// 从指定位置读取
+	q := NewProto808V()
+	n, err := UnserializeAt(bytes.NewReader(buf.Bytes()), int64(len(frames[0])), q)
+	assert.NoError(t, err)
+	assert.Equal(t, len(frames[1]), n)
+	assert.Equal(t, "2013", q.Variant)
+	assert.Equal(t, "8001", q.Code)
+	// 变长字段
+	b := NewBodyVarint()
+	b.Length, b.Delta, b.Offset = 300, -2, -65
+	chunk, err := Serialize(b)
+	assert.NoError(t, err)
+	n, err = UnserializeFrom(io.MultiReader(bytes.NewReader(chunk), strings.NewReader("next")), b)
+	assert.NoError(t, err)
+	assert.Equal(t, len(chunk), n)
+	// 逐段写入
+	buf.Reset()
+	n, err = SerializeTo(&buf, p)
+	assert.NoError(t, err)
+	assert.Equal(t, frames[1], buf.Bytes())
+	assert.Equal(t, len(frames[1]), n)
+}
+
+// 可选字段的长度由长度字段给出
+type BodyAckSized struct {
+	Size  uint8
+	Seqno uint16
+	Extra *uint16
+	*Object
+}
+
+func NewBodyAckSized() *BodyAckSized {
+	b := &BodyAckSized{Object: NewObject()}
+	b.AddUintField("size", 1)
+	b.AddUintField("seqno", 2)
+	b.AddUintField("extra", 2).Optional = true
+	b.SetLengthOf("size", "extra")
+	mustRef(b.Object, "size")
+	return b
+}
+
+// 连续的消息中第一个没有可选字段，数据流中不能多读
+func TestStreamOptional(t *testing.T) {
+	frames := [][]byte{common.Hex2Bin("0007020003"), common.Hex2Bin("00080200040102")}
+	data := append(append([]byte{}, frames[0]...), frames[1]...)
+	b := NewBodyAck()
+	n, err := UnserializeFrom(bytes.NewReader(data), b)
+	assert.True(t, errors.Is(err, ErrOptionalStream))
+	assert.Equal(t, 5, n)
+	// 从ReaderAt读取时可以探测
+	n, err = UnserializeAt(bytes.NewReader(frames[0]), 0, b)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Nil(t, b.Extra)
+	n, err = UnserializeAt(bytes.NewReader(data), 5, b)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, n)
+	if assert.NotNil(t, b.Extra) {
+		assert.Equal(t, uint16(0x0102), *b.Extra)
+	}
+	// 有长度字段时逐个读取
+	var buf bytes.Buffer
+	s := NewBodyAckSized()
+	s.Seqno = 7
+	_, err = SerializeTo(&buf, s)
+	assert.NoError(t, err)
+	extra := uint16(0x0102)
+	s.Seqno, s.Extra = 8, &extra
+	_, err = SerializeTo(&buf, s)
+	assert.NoError(t, err)
+	assert.Equal(t, "0000070200080102", common.Bin2Hex(buf.Bytes()))
+	r := NewBodyAckSized()
+	for i, size := range []int{3, 5} {
+		n, err = UnserializeFrom(&buf, r)
+		assert.NoError(t, err)
+		assert.Equal(t, size, n, "frame %d", i)
+	}
+	assert.Equal(t, uint16(8), r.Seqno)
+	if assert.NotNil(t, r.Extra) {
+		assert.Equal(t, extra, *r.Extra)
+	}
+	_, err = UnserializeFrom(&buf, r)
+	assert.Equal(t, io.EOF, err)
+}
+
+// 记录读取了多少字节
+type countingReaderAt struct {
+	io.ReaderAt
+	read int
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.read += n
+	return n, err
+}
+
+type BodyRecord struct {
+	Size uint64
+	Text []byte
+	*Object
+}
+
+// 从ReaderAt读取时只读需要的字节，不是整块缓冲
+func TestUnserializeAtExact(t *testing.T) {
+	data := make([]byte, 64*1024)
+	copy(data[1000:], append([]byte{0x05}, "hello"...))
+	newRecord := func() *BodyRecord {
+		b := &BodyRecord{Object: NewObject()}
+		b.AddUvarintField("size", 0)
+		b.AddBytesField("text", 0, false)
+		b.SetLengthOf("size", "text")
+		mustRef(b.Object, "size")
+		return b
+	}
+	r := &countingReaderAt{ReaderAt: bytes.NewReader(data)}
+	b := newRecord()
+	n, err := UnserializeAt(r, 1000, b)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, "hello", string(b.Text))
+	assert.LessOrEqual(t, r.read, 64+6) // 测量varint时最多预读64字节
+	// 在数据结尾的消息
+	r = &countingReaderAt{ReaderAt: bytes.NewReader(data[:1006])}
+	n, err = UnserializeAt(r, 1000, newRecord())
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	_, err = UnserializeAt(bytes.NewReader(data[:1004]), 1000, newRecord())
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+}
+
+// JT/T808位置信息的开头部分
+type BodyLocation struct {
+	Alarm  uint32
+	Status uint32
+	Point  GeoPoint
+	*Object
+}
+
+func NewBodyLocation() *BodyLocation {
+	b := &BodyLocation{Object: NewObject()}
+	b.AddUintField("alarm", 4)
+	b.AddUintField("status", 4)
+	b.AddGeoField("point", 4, ScaleMicro, SignNone)
+	return b
+}
+
+func TestGeo(t *testing.T) {
+	p := NewProto808()
+	assert.NoError(t, Unserialize(Unescape(common.Hex2Bin(data808)), p))
+	b := NewBodyLocation()
+	assert.NoError(t, Unserialize(p.Rest[:16], b))
+	assert.Equal(t, "29.951269,121.751595", b.Point.String())
+	// 符号在状态位中
+	pt := b.Point.WithHemisphere(b.Status&0x04 != 0, b.Status&0x08 != 0)
+	assert.Equal(t, b.Point, pt)
+	b.Point = NewGeoPoint(-33.8688, -151.2093)
+	chunk, err := Serialize(b)
+	assert.NoError(t, err)
+	assert.NoError(t, Unserialize(chunk, b))
+	assert.Equal(t, NewGeoPoint(33.8688, 151.2093), b.Point)
+	assert.Equal(t, NewGeoPoint(-33.8688, -151.2093), b.Point.WithHemisphere(true, true))
+	// 有符号整数和标志位
+	for _, sign := range []int{SignInteger, SignFlags} {
+		g := NewGeoCodec(4, ScaleMicro, sign)
+		south := NewGeoPoint(-22.906847, -43.172897)
+		chunk, err = g.Pack(south)
+		assert.NoError(t, err)
+		assert.Len(t, chunk, g.Length())
+		val, err := g.Unpack(chunk)
+		assert.NoError(t, err)
+		assert.Equal(t, south, val)
+	}
+	g := NewGeoCodec(4, ScaleMicro, SignInteger)
+	g.LonFirst = true
+	chunk = g.Encode(NewGeoPoint(1, -2))
+	assert.Equal(t, "ffe17b80000f4240", common.Bin2Hex(chunk))
+	_, err = g.Pack(NewGeoPoint(91, 0))
+	assert.Error(t, err)
+	// 距离和方位角
+	beijing, shanghai := NewGeoPoint(39.9042, 116.4074), NewGeoPoint(31.2304, 121.4737)
+	assert.InDelta(t, 1067311.6, beijing.Distance(shanghai), 1)
+	assert.InDelta(t, 153.07, beijing.Bearing(shanghai), 0.01)
+	assert.InDelta(t, 0, shanghai.Bearing(NewGeoPoint(40, 121.4737)), 1e-9)
+	assert.True(t, shanghai.Within(NewGeoPoint(31.23, 121.47), 500))
+	// 导出和导入
+	data, err := ToJSON(b)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"point":"33.868800,151.209300"`)
+	c := NewBodyLocation()
+	assert.NoError(t, FromJSON(data, c))
+	assert.Equal(t, b.Point, c.Point)
+	assert.False(t, beijing.Within(shanghai, 1000000))
+}
+
+type Device struct {
+	Addr   net.IP
+	Port   uint16
+	Mac    net.HardwareAddr
+	Uuid   UUID
+	Serial *big.Int
+	Imei   string
+	Iccid  string
+	*Object
+}
+
+func NewDevice() *Device {
+	d := &Device{Object: NewObject()}
+	d.AddIPField("addr", 4)
+	d.AddPortField("port")
+	d.AddMACField("mac")
+	d.AddUUIDField("uuid")
+	d.AddBigUintField("serial", 16)
+	d.AddIMEIField("imei")
+	d.AddICCIDField("iccid")
+	return d
+}
+
+func TestNetAddr(t *testing.T) {
+	d := NewDevice()
+	d.Addr = net.ParseIP("192.168.1.10")
+	d.Port = 8080
+	d.Mac, _ = net.ParseMAC("00:1a:2b:3c:4d:5e")
+	d.Uuid, _ = ParseUUID("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	d.Serial, _ = new(big.Int).SetString("340282366920938463463374607431768211455", 10)
+	d.Imei = "490154203237518"
+	d.Iccid = "8986041210199102318"
+	chunk, err := Serialize(d)
+	assert.NoError(t, err)
+	assert.Len(t, chunk, 4+2+6+16+16+8+10)
+	assert.Equal(t, "c0a8010a1f90001a2b3c4d5e", common.Bin2Hex(chunk[:12]))
+	assert.Equal(t, "0490154203237518", common.Bin2Hex(chunk[44:52]))
+	assert.Equal(t, "8986041210199102318f", common.Bin2Hex(chunk[52:]))
+	c := NewDevice()
+	assert.NoError(t, Unserialize(chunk, c))
+	assert.Equal(t, "192.168.1.10", c.Addr.String())
+	assert.Equal(t, d.Mac, c.Mac)
+	assert.Equal(t, "6ba7b810-9dad-11d1-80b4-00c04fd430c8", c.Uuid.String())
+	assert.Equal(t, 0, d.Serial.Cmp(c.Serial))
+	assert.Equal(t, d.Imei, c.Imei)
+	assert.Equal(t, d.Iccid, c.Iccid)
+	// 导出和导入
+	data, err := ToJSON(c)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"mac":"00:1a:2b:3c:4d:5e"`)
+	e := NewDevice()
+	assert.NoError(t, FromJSON(data, e))
+	assert.Equal(t, c.Uuid, e.Uuid)
+	assert.Equal(t, 0, c.Serial.Cmp(e.Serial))
+	assert.Equal(t, "192.168.1.10", e.Addr.String())
+	// 校验失败
+	d.Imei = "490154203237519"
+	_, err = Serialize(d)
+	assert.Error(t, err)
+	_, err = NewIPAddr(4).Pack("::1")
+	assert.Error(t, err)
+	_, err = NewBigUint(2).Pack(70000)
+	assert.Error(t, err)
+	_, err = ParseUUID("6ba7b810")
+	assert.Error(t, err)
+	digit, err := LuhnDigit("7992739871")
+	assert.NoError(t, err)
+	assert.Equal(t, byte('3'), digit)
+	assert.True(t, LuhnValid("79927398713"))
+}
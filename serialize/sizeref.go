@@ -0,0 +1,145 @@
+package serialize
+
+import (
+	"fmt"
+	"math/bits"
+	"reflect"
+
+	"github.com/azhai/gozzo-pck/match"
+)
+
+// 引用的种类
+const (
+	RefLength = "length" // 目标段的字节数
+	RefCount  = "count"  // 目标列表的元素个数
+	RefOffset = "offset" // 目标段的开始位置
+	RefEnd    = "end"    // 目标段的结束位置
+)
+
+// 长度或个数字段，编码时自动计算，解码时和实际数据核对
+type SizeRef struct {
+	Target string
+	Kind   string
+	Mask   uint64 // 只占用部分位，其余位保持原值，为0时使用全部位
+	Adjust int    // 存储值 = 实际值 + Adjust
+	Unit   int    // 计数时每个元素的字节数，为0时使用成员的元素个数
+}
+
+func (r *SizeRef) shift() uint {
+	if r.Mask == 0 {
+		return 0
+	}
+	return uint(bits.TrailingZeros64(r.Mask))
+}
+
+// 存储值中表示的实际值
+func (r *SizeRef) Extract(stored uint64) int {
+	if r.Mask != 0 {
+		stored = (stored & r.Mask) >> r.shift()
+	}
+	return int(stored) - r.Adjust
+}
+
+// 将实际值放入存储值，limit为字段能容纳的最大值
+func (r *SizeRef) Store(actual int, old, limit uint64) (uint64, error) {
+	value := actual + r.Adjust
+	if r.Mask != 0 {
+		limit = r.Mask >> r.shift()
+	}
+	if value < 0 || uint64(value) > limit {
+		return 0, fmt.Errorf("The %s %d of %s is out of range", r.Kind, actual, r.Target)
+	}
+	if r.Mask == 0 {
+		return uint64(value), nil
+	}
+	return old&^r.Mask | uint64(value)<<r.shift()&r.Mask, nil
+}
+
+// 有长度或个数字段的对象
+type IReferrer interface {
+	GetSizeRef(name string) (*SizeRef, bool)
+}
+
+// 字段中记录的长度或个数和实际数据不符
+type SizeError struct {
+	Kind   string
+	Target string
+	Want   int // 实际值
+	Got    int // 字段中记录的值
+}
+
+func (e *SizeError) Error() string {
+	tpl := "The %s of %s is %d, but got %d"
+	return fmt.Sprintf(tpl, e.Kind, e.Target, e.Want, e.Got)
+}
+
+func getSizeRef(s ISerializer, name string) (*SizeRef, bool) {
+	if rs, ok := s.(IReferrer); ok {
+		return rs.GetSizeRef(name)
+	}
+	return nil, false
+}
+
+// 字段能容纳的最大值，不定长的字段不限制
+func fieldLimit(field *match.Field) uint64 {
+	if field == nil || field.Measure != nil || field.Size <= 0 || field.Size >= 8 {
+		return ^uint64(0)
+	}
+	return 1<<(8*uint(field.Size)) - 1
+}
+
+// 元素个数，val为成员或解码后的值
+func countOf(ref *SizeRef, r match.Range, val interface{}) (int, bool) {
+	if ref.Unit > 0 {
+		return (r.Stop - r.Start) / ref.Unit, true
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		return rv.Len(), true
+	}
+	return 0, false
+}
+
+// 按种类得到实际值，个数无法得到时返回false
+func actualSize(ref *SizeRef, r match.Range, val interface{}) (int, bool) {
+	switch ref.Kind {
+	case RefCount:
+		return countOf(ref, r, val)
+	case RefOffset:
+		return r.Start, true
+	case RefEnd:
+		return r.Stop, true
+	}
+	return r.Stop - r.Start, true
+}
+
+// 核对各长度或个数字段，values为已解码的值
+func checkSizeRefs(s ISerializer, chunk []byte, ranges map[string]match.Range,
+	values map[string]interface{}) error {
+	for _, name := range s.GetMatcher().Names() {
+		ref, ok := getSizeRef(s, name)
+		if !ok {
+			continue
+		}
+		r, found := ranges[name]
+		target, exists := ranges[ref.Target]
+		child, has := s.GetChild(name)
+		if !found || !exists || !has {
+			continue
+		}
+		want, ok := actualSize(ref, target, values[ref.Target])
+		if !ok {
+			continue
+		}
+		val, err := ToCodec(child).Unpack(chunk[r.Start:r.Stop])
+		if err != nil {
+			return WrapFieldError(name, r.Start, err)
+		}
+		stored, _ := ToUint64(val)
+		if got := ref.Extract(stored); got != want {
+			err = &SizeError{Kind: ref.Kind, Target: ref.Target, Want: want, Got: got}
+			return WrapFieldError(name, r.Start, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package serialize
+
+import (
+	"errors"
+	"io"
+	"math"
+
+	"github.com/azhai/gozzo-pck/match"
+)
+
+// 数据流中无法判断可选字段是否存在，读下去会吃掉下一个消息的字节
+var ErrOptionalStream = errors.New("Can not probe the optional field in a stream without a length field")
+
+// 从数据流中按需读取，不会多读属于下一个消息的字节
+// 来源为io.ReaderAt时测量不定长段可以预读，消息只包含前size个字节
+type frameReader struct {
+	r    io.Reader
+	ra   io.ReaderAt
+	off  int64 // ra中消息的开始位置
+	buf  []byte
+	size int
+}
+
+func (fr *frameReader) data() []byte {
+	return fr.buf[:fr.size]
+}
+
+// 再读取n个字节，full为false时来源为io.ReaderAt的可以少读
+func (fr *frameReader) read(n int, full bool) error {
+	chunk := make([]byte, n)
+	var (
+		m   int
+		err error
+	)
+	if fr.ra != nil {
+		if m, err = fr.ra.ReadAt(chunk, fr.off+int64(len(fr.buf))); m == n || (m > 0 && !full) {
+			err = nil
+		}
+	} else {
+		m, err = io.ReadFull(fr.r, chunk)
+	}
+	fr.buf = append(fr.buf, chunk[:m]...)
+	if err == io.EOF && len(fr.buf) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// 读到至少size个字节，读了一部分就结束时为io.ErrUnexpectedEOF
+func (fr *frameReader) fill(size int) error {
+	var err error
+	if n := size - len(fr.buf); n > 0 {
+		err = fr.read(n, true)
+	}
+	if size > len(fr.buf) {
+		size = len(fr.buf)
+	}
+	if size > fr.size { // 消息只会变长
+		fr.size = size
+	}
+	return err
+}
+
+// 测量不定长段时多读一些，数据流每次只读1个字节
+func (fr *frameReader) more() error {
+	if fr.ra == nil {
+		return fr.read(1, true)
+	}
+	n := len(fr.buf)
+	if n < 64 {
+		n = 64
+	}
+	return fr.read(n, false)
+}
+
+// 读到数据结束
+func (fr *frameReader) readAll() error {
+	r := fr.r
+	if fr.ra != nil {
+		off := fr.off + int64(len(fr.buf))
+		r = io.NewSectionReader(fr.ra, off, math.MaxInt64-off)
+	}
+	rest, err := io.ReadAll(r)
+	fr.buf = append(fr.buf, rest...)
+	fr.size = len(fr.buf)
+	return err
+}
+
+// 数据流中断，还没有读到任何字节时为io.EOF
+func (fr *frameReader) wrap(name string, offset int, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return WrapFieldError(name, offset, err)
+}
+
+// 从已读取的长度或个数字段中得到目标段的长度
+func knownLength(l ISerializer, target string, start int, data []byte,
+	ranges map[string]match.Range) (int, bool) {
+	for _, name := range l.GetMatcher().Names() {
+		ref, ok := getSizeRef(l, name)
+		r, found := ranges[name]
+		if !ok || !found || ref.Target != target {
+			continue
+		}
+		child, _ := l.GetChild(name)
+		val, err := ToCodec(child).Unpack(data[r.Start:r.Stop])
+		if err != nil {
+			continue
+		}
+		stored, _ := ToUint64(val)
+		n := ref.Extract(stored)
+		switch ref.Kind {
+		case RefLength:
+			return n, n >= 0
+		case RefCount:
+			return n * ref.Unit, ref.Unit > 0 && n >= 0
+		case RefEnd:
+			return n - start, n >= start
+		}
+	}
+	return 0, false
+}
+
+// 读取一个完整的消息，rest的长度可以由长度字段得到，否则有结尾段时读到数据结束
+func readFrame(fr *frameReader, s ISerializer) error {
+	l := s
+	if sel, ok := s.(ISelector); ok {
+		_, least := s.GetMatcher().GetLeastSize()
+		if err := fr.fill(least); err != nil {
+			return fr.wrap("", 0, err)
+		}
+		if err := sel.Select(fr.data()); err != nil {
+			return WrapFieldError("", 0, err)
+		}
+	} else if vc, ok := s.(variantChooser); ok {
+		_, least := s.GetMatcher().GetLeastSize()
+		if err := fr.fill(least); err != nil {
+			return fr.wrap("", 0, err)
+		}
+		name, err := vc.chooseVariant(fr.data())
+		if err != nil {
+			return WrapFieldError("", 0, err)
+		}
+		if l, ok = vc.variantLayout(name); !ok {
+			l = s // 由解码时报告错误
+		}
+	}
+	var (
+		m       = l.GetMatcher()
+		rest    = m.GetField("rest")
+		revSize = -rest.Stop // 结尾各段的长度
+		ranges  = make(map[string]match.Range)
+		offset  = 0
+	)
+	for _, name := range m.Sequence {
+		field := m.GetField(name)
+		start, stop := field.GetRange(offset)
+		switch {
+		case field.Optional: // 读不到时视为不存在
+			if revSize > 0 {
+				return fr.readAll()
+			}
+			if fr.ra == nil { // 数据流中只能由长度字段判断
+				n, ok := knownLength(l, name, start, fr.data(), ranges)
+				if !ok {
+					return WrapFieldError(name, start, ErrOptionalStream)
+				} else if n == 0 {
+					return nil
+				}
+				stop = start + n
+				if err := fr.fill(stop); err != nil {
+					return fr.wrap(name, start, err)
+				}
+			} else if err := fr.fill(stop); err != nil {
+				if err == io.ErrUnexpectedEOF {
+					return nil
+				}
+				return fr.wrap(name, start, err)
+			}
+		case field.Measure != nil: // 逐个字节读取，直到可以测量长度
+			if err := fr.fill(start + field.Size); err != nil {
+				return fr.wrap(name, start, err)
+			}
+			for {
+				n := field.Measure(fr.buf[start:])
+				if n >= 0 && start+n <= len(fr.buf) {
+					stop, offset = start+n, offset+n-field.Size
+					fr.fill(stop)
+					break
+				}
+				if err := fr.more(); err != nil {
+					return fr.wrap(name, start, err)
+				}
+			}
+		case field.Size == 0: // 直到数据结尾
+			n, ok := knownLength(l, name, start, fr.data(), ranges)
+			if !ok {
+				return fr.readAll()
+			}
+			return fr.wrap(name, start, fr.fill(start+n+revSize))
+		default:
+			if err := fr.fill(stop); err != nil {
+				return fr.wrap(name, start, err)
+			}
+		}
+		ranges[name] = match.Range{Start: start, Stop: stop}
+	}
+	start, _ := rest.GetRange(0)
+	start += offset
+	if n, ok := knownLength(l, "rest", start, fr.data(), ranges); ok {
+		return fr.wrap("rest", start, fr.fill(start+n+revSize))
+	} else if revSize > 0 {
+		return fr.readAll()
+	}
+	return nil
+}
+
+// 从数据流中读取一个消息并解码，返回读取的字节数
+// 没有任何数据时返回io.EOF，可以循环读取多个消息
+// 可选字段需要有长度字段，否则返回ErrOptionalStream，可以改用UnserializeAt
+func UnserializeFrom(r io.Reader, s ISerializer) (int, error) {
+	return unserializeFrame(&frameReader{r: r}, s)
+}
+
+// 从指定位置读取一个消息并解码，返回读取的字节数
+// 只读取消息需要的字节，不定长段测量长度时可能多读，但不计入消息
+func UnserializeAt(r io.ReaderAt, off int64, s ISerializer) (int, error) {
+	return unserializeFrame(&frameReader{ra: r, off: off}, s)
+}
+
+func unserializeFrame(fr *frameReader, s ISerializer) (int, error) {
+	if err := readFrame(fr, s); err != nil {
+		return fr.size, err
+	}
+	return fr.size, Unserialize(fr.data(), s)
+}
+
+// 编码后逐段写入，不组装完整的消息，返回写入的字节数
+func SerializeTo(w io.Writer, s ISerializer) (int, error) {
+	m, data, err := packFields(s, newStructStore(s))
+	if err != nil {
+		return 0, err
+	}
+	return m.BuildTo(w, data)
+}
@@ -0,0 +1,385 @@
+package serialize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/azhai/gozzo-utils/common"
+	"gopkg.in/yaml.v2"
+)
+
+// 节点类型
+const (
+	NodeValue  = "value"
+	NodeObject = "object"
+	NodeList   = "list"
+)
+
+// 解码后的值，对象的子节点按字段顺序排列
+type Node struct {
+	Name     string
+	Kind     string
+	Type     string // 值的类型，如uint16、time.Time
+	Value    interface{}
+	Children []*Node
+}
+
+func (n *Node) Get(name string) *Node {
+	for _, child := range n.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+func newNode(name string, val interface{}) *Node {
+	node := &Node{Name: name, Kind: NodeValue, Type: fmt.Sprintf("%T", val), Value: val}
+	switch v := val.(type) {
+	case ISerializer:
+		if rv := reflect.ValueOf(v); rv.Kind() != reflect.Ptr || !rv.IsNil() {
+			obj := ToTree(v)
+			obj.Name, obj.Type = name, node.Type
+			return obj
+		}
+	case []interface{}:
+		node.Kind, node.Value = NodeList, nil
+		for i, item := range v {
+			node.Children = append(node.Children, newNode(fmt.Sprintf("[%d]", i), item))
+		}
+	default:
+		rv := reflect.ValueOf(val)
+		if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8 {
+			node.Kind, node.Value = NodeList, nil
+			for i := 0; i < rv.Len(); i++ {
+				item := rv.Index(i).Interface()
+				node.Children = append(node.Children, newNode(fmt.Sprintf("[%d]", i), item))
+			}
+		}
+	}
+	return node
+}
+
+// 从结构体中读取各字段的值，空的rest不列出
+func ToTree(s ISerializer) *Node {
+	root := &Node{Kind: NodeObject, Type: fmt.Sprintf("%T", s)}
+	names := s.GetNames()
+	rv := reflect.Indirect(reflect.ValueOf(s))
+	for _, name := range s.GetMatcher().Names() {
+		rf := rv.FieldByName(names[name])
+		if _, ok := s.GetChild(name); !ok || !rf.IsValid() || !rf.CanInterface() {
+			continue
+		}
+		if name == "rest" && rf.Len() == 0 {
+			continue
+		}
+		root.Children = append(root.Children, newNode(name, rf.Interface()))
+	}
+	return root
+}
+
+// 不需要结构体成员，按布局直接解码为树
+func DecodeTree(chunk []byte, s ISerializer) (*Node, error) {
+	s, err := decodeLayout(s, chunk, new(Message))
+	if err != nil {
+		return nil, WrapFieldError("", 0, err)
+	}
+	m := s.GetMatcher()
+	ranges, err := m.Ranges(chunk, true)
+	if err != nil {
+		return nil, WrapFieldError("", 0, err)
+	}
+	root := &Node{Kind: NodeObject, Type: fmt.Sprintf("%T", s)}
+	values := make(map[string]interface{})
+	for _, name := range m.Names() {
+		child, ok := s.GetChild(name)
+		r, found := ranges[name]
+		if found {
+			if err = checkConstraint(s, name, chunk[r.Start:r.Stop]); err != nil {
+				return nil, WrapFieldError(name, r.Start, err)
+			}
+		}
+		if !ok || !found || (name == "rest" && r.Start == r.Stop) {
+			continue
+		}
+		val, err := ToCodec(child).Unpack(chunk[r.Start:r.Stop])
+		if err != nil {
+			return nil, WrapFieldError(name, r.Start, err)
+		}
+		root.Children = append(root.Children, newNode(name, val))
+		values[name] = val
+	}
+	if err = checkSizeRefs(s, chunk, ranges, values); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// 转为JSON或YAML中的值，字节数组为16进制，时间为RFC3339格式
+func exportValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []byte:
+		return common.Bin2Hex(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case FlagSet:
+		return v.Names()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return val
+}
+
+func (n *Node) MarshalJSON() ([]byte, error) {
+	switch n.Kind {
+	case NodeObject:
+		var buf bytes.Buffer
+		buf.WriteByte('{')
+		for i, child := range n.Children {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(child.Name)
+			buf.Write(key)
+			buf.WriteByte(':')
+			data, err := child.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(data)
+		}
+		buf.WriteByte('}')
+		return buf.Bytes(), nil
+	case NodeList:
+		items := make([]*Node, len(n.Children))
+		copy(items, n.Children)
+		return json.Marshal(items)
+	}
+	return json.Marshal(exportValue(n.Value))
+}
+
+func (n *Node) MarshalYAML() (interface{}, error) {
+	switch n.Kind {
+	case NodeObject:
+		items := make(yaml.MapSlice, len(n.Children))
+		for i, child := range n.Children {
+			items[i] = yaml.MapItem{Key: child.Name, Value: child}
+		}
+		return items, nil
+	case NodeList:
+		return n.Children, nil
+	}
+	return exportValue(n.Value), nil
+}
+
+func ToJSON(s ISerializer) ([]byte, error) {
+	return json.Marshal(ToTree(s))
+}
+
+func ToYAML(s ISerializer) ([]byte, error) {
+	return yaml.Marshal(ToTree(s))
+}
+
+// 从JSON文档填充结构体，之后可以用Serialize组装
+func FromJSON(data []byte, s ISerializer) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	return FillValues(s, doc)
+}
+
+// 从YAML文档填充结构体
+func FromYAML(data []byte, s ISerializer) error {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	return FillValues(s, doc)
+}
+
+// 按字段名填充结构体，文档中没有的字段保持不变
+func FillValues(s ISerializer, doc map[string]interface{}) error {
+	names := s.GetNames()
+	rv := reflect.Indirect(reflect.ValueOf(s))
+	for _, name := range s.GetMatcher().Names() {
+		v, ok := doc[name]
+		child, found := s.GetChild(name)
+		rf := rv.FieldByName(names[name])
+		if !ok || !found || !rf.IsValid() || !rf.CanSet() {
+			continue
+		}
+		if err := fillValue(rf, child, v); err != nil {
+			return WrapFieldError(name, 0, err)
+		}
+	}
+	return nil
+}
+
+// YAML解析出的对象为map[interface{}]interface{}
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		doc := make(map[string]interface{})
+		for key, val := range v {
+			doc[fmt.Sprint(key)] = val
+		}
+		return doc, true
+	}
+	return nil, false
+}
+
+func fillValue(rf reflect.Value, codec IEncoder, v interface{}) error {
+	rt := rf.Type()
+	switch c := codec.(type) {
+	case *ObjectCodec:
+		doc, ok := toStringMap(v)
+		if !ok {
+			return typeError("object", v)
+		}
+		obj := c.Create()
+		if err := FillValues(obj, doc); err != nil {
+			return err
+		}
+		return SetValue(rf, obj)
+	case *List:
+		items, ok := v.([]interface{})
+		if !ok || rt.Kind() != reflect.Slice {
+			return typeError("list", v)
+		}
+		enc, _ := c.Item.(IEncoder)
+		list := reflect.MakeSlice(rt, len(items), len(items))
+		for i, item := range items {
+			if err := fillValue(list.Index(i), enc, item); err != nil {
+				return WrapFieldError(fmt.Sprintf("[%d]", i), 0, err)
+			}
+		}
+		rf.Set(list)
+		return nil
+	case *Flags:
+		if names, ok := v.([]interface{}); ok {
+			set := c.NewSet(0)
+			for _, name := range names {
+				if err := set.Set(fmt.Sprint(name), true); err != nil {
+					return err
+				}
+			}
+			return SetValue(rf, set)
+		}
+	case *IPAddr, *MACAddr, *UUIDCodec, *BigUint:
+		switch v.(type) {
+		case string, json.Number: // 编码后再解码为成员的类型
+			return fillPacked(rf, ToCodec(codec), v)
+		}
+	case *GeoCodec:
+		if text, ok := v.(string); ok {
+			p, err := ParseGeoPoint(text)
+			if err != nil {
+				return err
+			}
+			return SetValue(rf, p)
+		}
+	case *Enum:
+		if remark, ok := v.(string); ok {
+			i := c.Opts.ByRemark(remark, false)
+			if i < 0 {
+				return fmt.Errorf("Can not found the options of %s", remark)
+			}
+			value, _ := c.Opts.Item(i)
+			return SetValue(rf, value)
+		}
+	}
+	return convertValue(rf, v)
+}
+
+func fillPacked(rf reflect.Value, codec ICodec, v interface{}) error {
+	chunk, err := codec.Pack(v)
+	if err != nil {
+		return err
+	}
+	val, err := codec.Unpack(chunk)
+	if err != nil {
+		return err
+	}
+	return SetValue(rf, val)
+}
+
+// 将文档中的标量转为成员的类型
+func convertValue(rf reflect.Value, v interface{}) error {
+	rt := rf.Type()
+	text, isText := v.(string)
+	switch {
+	case rt == reflect.TypeOf(time.Time{}) && isText:
+		t, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return err
+		}
+		rf.Set(reflect.ValueOf(t))
+		return nil
+	case rt.Kind() == reflect.Slice && rt.Elem().Kind() == reflect.Uint8 && isText:
+		chunk := common.Hex2Bin(strings.TrimPrefix(text, "0x"))
+		if chunk == nil && text != "" {
+			return fmt.Errorf("Invalid hex string %q", text)
+		}
+		rf.SetBytes(chunk)
+		return nil
+	case isNumber(rt.Kind()):
+		return convertNumber(rf, v)
+	}
+	return SetValue(rf, v)
+}
+
+// 数字都先转为文本再解析，YAML中的int和float64也检查范围，不会被截断
+func convertNumber(rf reflect.Value, v interface{}) error {
+	var num string
+	switch v := v.(type) {
+	case json.Number:
+		num = v.String()
+	case string:
+		num = v
+	default:
+		if rv := reflect.ValueOf(v); !rv.IsValid() || !isNumber(rv.Kind()) {
+			return SetValue(rf, v)
+		}
+		num = fmt.Sprint(v)
+	}
+	switch rf.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return err
+		} else if rf.OverflowFloat(f) {
+			return fmt.Errorf("The number %s is overflow for %s", num, rf.Type())
+		}
+		rf.SetFloat(f)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(num, 0, 64)
+		if err == nil && rf.OverflowUint(n) {
+			err = fmt.Errorf("The number %s is overflow for %s", num, rf.Type())
+		}
+		if err != nil {
+			return err
+		}
+		rf.SetUint(n)
+		return nil
+	}
+	n, err := strconv.ParseInt(num, 0, 64)
+	if err == nil && rf.OverflowInt(n) {
+		err = fmt.Errorf("The number %s is overflow for %s", num, rf.Type())
+	}
+	if err != nil {
+		return err
+	}
+	rf.SetInt(n)
+	return nil
+}
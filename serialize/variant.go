@@ -0,0 +1,180 @@
+package serialize
+
+import (
+	"fmt"
+
+	"github.com/azhai/gozzo-pck/match"
+)
+
+// 解码前根据数据选择布局的对象
+type ISelector interface {
+	Select(chunk []byte) error
+	GetAllNames() map[string]string // 所有版本的字段
+}
+
+// 从数据中识别版本，如JT/T808消息属性的版本标识位
+type Discriminator func(chunk []byte) (string, error)
+
+// 同一类消息的多个版本，共用结构体成员，每个版本有自己的布局
+type Variants struct {
+	Variant      string // 当前使用的版本，解码后为识别出的版本
+	Discriminate Discriminator
+	layouts      map[string]*Object
+}
+
+func NewVariants(discriminate Discriminator) *Variants {
+	return &Variants{
+		Discriminate: discriminate,
+		layouts:      make(map[string]*Object),
+	}
+}
+
+// 增加一个版本，在返回的对象上添加字段，第一个版本为默认版本
+func (v *Variants) AddVariant(name string) *Object {
+	obj := NewObject()
+	v.layouts[name] = obj
+	if v.Variant == "" {
+		v.Variant = name
+	}
+	return obj
+}
+
+func (v *Variants) GetVariant(name string) (*Object, bool) {
+	obj, ok := v.layouts[name]
+	return obj, ok
+}
+
+// 编码前指定版本
+func (v *Variants) SetVariant(name string) error {
+	if _, ok := v.layouts[name]; !ok {
+		return fmt.Errorf("Unknown variant %s", name)
+	}
+	v.Variant = name
+	return nil
+}
+
+func (v *Variants) Select(chunk []byte) error {
+	if v.Discriminate == nil {
+		return nil
+	}
+	name, err := v.Discriminate(chunk)
+	if err == nil {
+		err = v.SetVariant(name)
+	}
+	return err
+}
+
+// 当前版本的布局，Variant被改为不存在的版本时返回错误
+func (v *Variants) currentLayout() (*Object, error) {
+	if obj, ok := v.layouts[v.Variant]; ok {
+		return obj, nil
+	}
+	return nil, fmt.Errorf("Unknown variant %s", v.Variant)
+}
+
+// 版本不存在时使用空的布局，编解码由encodeLayout和decodeLayout返回错误
+func (v *Variants) current() *Object {
+	if obj, err := v.currentLayout(); err == nil {
+		return obj
+	}
+	return NewObject()
+}
+
+func (v *Variants) GetMatcher() *match.FieldMatcher {
+	return v.current().GetMatcher()
+}
+
+func (v *Variants) GetNames() map[string]string {
+	return v.current().GetNames()
+}
+
+func (v *Variants) GetAllNames() map[string]string {
+	names := make(map[string]string)
+	for _, obj := range v.layouts {
+		for name, member := range obj.GetNames() {
+			names[name] = member
+		}
+	}
+	return names
+}
+
+func (v *Variants) GetChild(name string) (IEncoder, bool) {
+	return v.current().GetChild(name)
+}
+
+func (v *Variants) GetConstraint(name string) (*Constraint, bool) {
+	return v.current().GetConstraint(name)
+}
+
+func (v *Variants) GetSizeRef(name string) (*SizeRef, bool) {
+	return v.current().GetSizeRef(name)
+}
+
+// 编译布局时读取各版本
+func (v *Variants) variantLayouts() (map[string]*Object, Discriminator, string) {
+	return v.layouts, v.Discriminate, v.Variant
+}
+
+// 自身保存当前版本的布局，即嵌入了*Variants
+type variantHolder interface {
+	currentLayout() (*Object, error)
+}
+
+// 不修改自身的版本选择，用于共用的布局
+type variantChooser interface {
+	chooseVariant(chunk []byte) (string, error)
+	variantLayout(name string) (ISerializer, bool)
+}
+
+// 编码时使用的布局，共用的布局按消息中记录的版本
+func encodeLayout(s ISerializer, st valueStore) (ISerializer, error) {
+	if vh, ok := s.(variantHolder); ok {
+		if _, err := vh.currentLayout(); err != nil {
+			return nil, err
+		}
+	}
+	vc, ok := s.(variantChooser)
+	if !ok {
+		return s, nil
+	}
+	if l, found := vc.variantLayout(st.variant()); found {
+		return l, nil
+	}
+	return nil, fmt.Errorf("Unknown variant %s", st.variant())
+}
+
+// 解码前选择版本，并清空其他版本独有的字段
+func decodeLayout(s ISerializer, chunk []byte, st valueStore) (ISerializer, error) {
+	var (
+		l        = s
+		allNames map[string]string
+	)
+	if sel, ok := s.(ISelector); ok {
+		if err := sel.Select(chunk); err != nil {
+			return nil, err
+		}
+		if vh, ok := s.(variantHolder); ok { // 没有Discriminate时不会检查版本
+			if _, err := vh.currentLayout(); err != nil {
+				return nil, err
+			}
+		}
+		allNames = sel.GetAllNames()
+	} else if vc, ok := s.(variantChooser); ok {
+		name, err := vc.chooseVariant(chunk)
+		if err != nil {
+			return nil, err
+		}
+		if l, ok = vc.variantLayout(name); !ok {
+			return nil, fmt.Errorf("Unknown variant %s", name)
+		}
+		allNames = s.GetNames()
+		st.setVariant(name)
+	}
+	names := l.GetNames()
+	for name := range allNames {
+		if _, ok := names[name]; !ok {
+			st.reset(name)
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,214 @@
+package serialize
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+)
+
+const (
+	MaxVarintLen = binary.MaxVarintLen64 // 64位变长整数最多10字节
+	MaxMqttLen   = 4                     // MQTT剩余长度最多4字节
+)
+
+var ErrVarint = errors.New("Invalid or overflow varint")
+
+// 将各种整数转为uint64，有符号数按补码
+func ToUint64(v interface{}) (uint64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(rv.Int()), true
+	}
+	return 0, false
+}
+
+// 将各种整数转为int64，无符号数按补码
+func ToInt64(v interface{}) (int64, bool) {
+	n, ok := ToUint64(v)
+	return int64(n), ok
+}
+
+// ZigZag编码，让绝对值小的负数也只占很少的字节
+func ZigZagEncode(n int64) uint64 {
+	return uint64(n<<1) ^ uint64(n>>63)
+}
+
+func ZigZagDecode(n uint64) int64 {
+	return int64(n>>1) ^ -int64(n&1)
+}
+
+// 兼容IEncoder，超出MaxSize或类型不符时返回nil，需要错误时使用Pack
+// 这些类型都实现了ICodec，作为字段时总是使用Pack，错误不会丢失
+func packOrNil(chunk []byte, err error) []byte {
+	if err != nil {
+		return nil
+	}
+	return chunk
+}
+
+// 找出变长整数的长度，最后一个字节的最高位为0
+func MeasureVarint(data []byte) int {
+	for i, b := range data {
+		if i >= MaxVarintLen {
+			break
+		} else if b < 0x80 {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// 无符号变长整数，LEB128编码，也用于protobuf的uint64
+type Uvarint struct {
+	MaxSize int // 最多字节数，0表示10字节
+}
+
+func NewUvarint(maxSize int) *Uvarint {
+	return &Uvarint{MaxSize: maxSize}
+}
+
+func (n Uvarint) maxSize() int {
+	if n.MaxSize <= 0 || n.MaxSize > MaxVarintLen {
+		return MaxVarintLen
+	}
+	return n.MaxSize
+}
+
+func (n Uvarint) Measure(data []byte) int {
+	if size := MeasureVarint(data); size <= n.maxSize() {
+		return size
+	}
+	return -1
+}
+
+func (n Uvarint) Pack(v interface{}) ([]byte, error) {
+	x, ok := ToUint64(v)
+	if !ok {
+		return nil, typeError("integer", v)
+	}
+	chunk := make([]byte, MaxVarintLen)
+	chunk = chunk[:binary.PutUvarint(chunk, x)]
+	if len(chunk) > n.maxSize() {
+		return nil, ErrVarint
+	}
+	return chunk, nil
+}
+
+func (n Uvarint) DecodeUint64(chunk []byte) (uint64, error) {
+	x, size := binary.Uvarint(chunk)
+	if size <= 0 || size > n.maxSize() {
+		return 0, ErrVarint
+	}
+	return x, nil
+}
+
+func (n Uvarint) Unpack(chunk []byte) (interface{}, error) {
+	return n.DecodeUint64(chunk)
+}
+
+func (n Uvarint) Encode(v interface{}) []byte {
+	return packOrNil(n.Pack(v))
+}
+
+func (n Uvarint) Decode(chunk []byte) interface{} {
+	return valueOrError(n.Unpack(chunk))
+}
+
+// 有符号变长整数，SLEB128编码，最后一个字节的第6位为符号位
+type Varint struct {
+	MaxSize int // 最多字节数，0表示10字节
+}
+
+func NewVarint(maxSize int) *Varint {
+	return &Varint{MaxSize: maxSize}
+}
+
+func (n Varint) Measure(data []byte) int {
+	return Uvarint(n).Measure(data)
+}
+
+func (n Varint) Pack(v interface{}) ([]byte, error) {
+	x, ok := ToInt64(v)
+	if !ok {
+		return nil, typeError("integer", v)
+	}
+	var chunk []byte
+	for {
+		b := byte(x & 0x7f)
+		x >>= 7 // 算术右移，保留符号
+		if (x == 0 && b&0x40 == 0) || (x == -1 && b&0x40 != 0) {
+			chunk = append(chunk, b)
+			break
+		}
+		chunk = append(chunk, b|0x80)
+	}
+	if len(chunk) > Uvarint(n).maxSize() {
+		return nil, ErrVarint
+	}
+	return chunk, nil
+}
+
+func (n Varint) DecodeInt64(chunk []byte) (int64, error) {
+	size := n.Measure(chunk)
+	if size <= 0 {
+		return 0, ErrVarint
+	}
+	var x int64
+	shift := uint(0)
+	for _, b := range chunk[:size] {
+		x |= int64(b&0x7f) << shift
+		shift += 7
+	}
+	if last := chunk[size-1]; shift < 64 && last&0x40 != 0 {
+		x |= -1 << shift // 负数，高位补1
+	}
+	return x, nil
+}
+
+func (n Varint) Unpack(chunk []byte) (interface{}, error) {
+	return n.DecodeInt64(chunk)
+}
+
+func (n Varint) Encode(v interface{}) []byte {
+	return packOrNil(n.Pack(v))
+}
+
+func (n Varint) Decode(chunk []byte) interface{} {
+	return valueOrError(n.Unpack(chunk))
+}
+
+// ZigZag编码的变长整数，即protobuf的sint64
+type ZigZag struct {
+	Uvarint
+}
+
+func NewZigZag(maxSize int) *ZigZag {
+	return &ZigZag{Uvarint: Uvarint{MaxSize: maxSize}}
+}
+
+func (n ZigZag) Pack(v interface{}) ([]byte, error) {
+	x, ok := ToInt64(v)
+	if !ok {
+		return nil, typeError("integer", v)
+	}
+	return n.Uvarint.Pack(ZigZagEncode(x))
+}
+
+func (n ZigZag) Unpack(chunk []byte) (interface{}, error) {
+	x, err := n.Uvarint.DecodeUint64(chunk)
+	if err != nil {
+		return nil, err
+	}
+	return ZigZagDecode(x), nil
+}
+
+func (n ZigZag) Encode(v interface{}) []byte {
+	return packOrNil(n.Pack(v))
+}
+
+func (n ZigZag) Decode(chunk []byte) interface{} {
+	return valueOrError(n.Unpack(chunk))
+}
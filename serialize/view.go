@@ -0,0 +1,96 @@
+package serialize
+
+import (
+	"fmt"
+)
+
+// 原始数据上的只读视图，访问字段时才解码，不创建结构体
+// 不核对长度或个数字段，需要时用Unserialize或Layout.Decode
+type View struct {
+	Variant string
+	chunk   []byte
+	layout  ISerializer
+}
+
+// 通常使用编译后的布局，有多个版本时先识别版本
+func NewView(chunk []byte, s ISerializer) (*View, error) {
+	v := &View{chunk: chunk, layout: s}
+	if vc, ok := s.(variantChooser); ok {
+		name, err := vc.chooseVariant(chunk)
+		if err != nil {
+			return nil, WrapFieldError("", 0, err)
+		}
+		if v.layout, ok = vc.variantLayout(name); !ok {
+			return nil, fmt.Errorf("Unknown variant %s", name)
+		}
+		v.Variant = name
+	}
+	return v, nil
+}
+
+func (v *View) Chunk() []byte {
+	return v.chunk
+}
+
+// 数据中是否有这个字段，不存在的可选字段返回false
+func (v *View) Has(name string) bool {
+	_, found, err := v.layout.GetMatcher().RangeOf(v.chunk, name)
+	return found && err == nil
+}
+
+// 字段的原始字节，不存在的可选字段返回nil
+func (v *View) Raw(name string) ([]byte, error) {
+	r, found, err := v.layout.GetMatcher().RangeOf(v.chunk, name)
+	if err != nil {
+		return nil, WrapFieldError("", 0, err)
+	}
+	if !found {
+		return nil, v.notFound(name)
+	}
+	chunk := v.chunk[r.Start:r.Stop]
+	if err = checkConstraint(v.layout, name, chunk); err != nil {
+		return nil, WrapFieldError(name, r.Start, err)
+	}
+	return chunk, nil
+}
+
+// 不存在的可选字段不是错误
+func (v *View) notFound(name string) error {
+	if field := v.layout.GetMatcher().GetField(name); field != nil && field.Optional {
+		return nil
+	}
+	return fmt.Errorf("Can not found the field %s", name)
+}
+
+// 解码一个字段，不存在的可选字段返回nil
+func (v *View) Get(name string) (interface{}, error) {
+	r, found, err := v.layout.GetMatcher().RangeOf(v.chunk, name)
+	if err != nil {
+		return nil, WrapFieldError("", 0, err)
+	}
+	child, ok := v.layout.GetChild(name)
+	if !found || !ok {
+		return nil, v.notFound(name)
+	}
+	chunk := v.chunk[r.Start:r.Stop]
+	if err = checkConstraint(v.layout, name, chunk); err != nil {
+		return nil, WrapFieldError(name, r.Start, err)
+	}
+	val, err := ToCodec(child).Unpack(chunk)
+	if err != nil {
+		return nil, WrapFieldError(name, r.Start, err)
+	}
+	return val, nil
+}
+
+// 解码为字符串，用于路由时比较命令ID、手机号等
+func (v *View) GetString(name string) (string, error) {
+	val, err := v.Get(name)
+	if err != nil || val == nil {
+		return "", err
+	}
+	if text, ok := val.(string); ok {
+		return text, nil
+	}
+	return fmt.Sprint(val), nil
+}